@@ -1,21 +1,44 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 
 	"github.com/shirou/gofile/internal/magic"
 )
 
 func main() {
 	brief := flag.Bool("b", false, "brief mode (no filename)")
-	mimeType := flag.Bool("i", false, "output MIME type")
+	mime := flag.Bool("i", false, "output MIME type and charset (type; charset=...)")
+	mimeType := flag.Bool("mime-type", false, "output MIME type only")
+	mimeEncoding := flag.Bool("mime-encoding", false, "output MIME charset only")
+	extension := flag.Bool("extension", false, "output valid extensions for the file type")
+	apple := flag.Bool("apple", false, "output the Apple creator/type code")
+	useMmap := flag.Bool("mmap", false, "memory-map regular files instead of reading them (Linux)")
 	listMode := flag.Bool("l", false, "list magic entries with strength")
-	magicFile := flag.String("m", "", "magic file or directory path")
+	check := flag.Bool("c", false, "check the magic rules and print load-time warnings")
+	magicFile := flag.String("m", "", "magic file, directory or snapshot path")
+	snapshot := flag.String("write-snapshot", "", "write the loaded magic rules to a snapshot file and exit")
 	separator := flag.String("F", ":", "separator")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
+	var opts magic.Options
+	flag.Func("P", "set a limit, as name=value (names: "+strings.Join(magic.ParamNames(), ", ")+")", func(p string) error {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok {
+			return fmt.Errorf("want name=value, got %q", p)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for param %s", value, name)
+		}
+		return opts.SetParam(name, n)
+	})
 	flag.Parse()
 
 	if *cpuprofile != "" {
@@ -36,10 +59,12 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	opts := magic.Options{
-		MimeType: *mimeType,
-		Brief:    *brief,
-	}
+	opts.MimeType = *mime || *mimeType
+	opts.MimeEncoding = *mime || *mimeEncoding
+	opts.Extension = *extension
+	opts.Apple = *apple
+	opts.Mmap = *useMmap
+	opts.Brief = *brief
 
 	var fi *magic.FileIdentifier
 	var err error
@@ -54,6 +79,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *check {
+		diags := fi.Diagnostics()
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if len(diags) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *snapshot != "" {
+		if err := writeSnapshot(fi, *snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "file: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *listMode {
 		entries := fi.List()
 		var binEntries, textEntries []magic.ListEntry
@@ -89,20 +133,66 @@ func main() {
 
 	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: file [-bil] [-m magic] [-F separator] file ...\n")
+		fmt.Fprintf(os.Stderr, "Usage: file [-bil] [-m magic] [-F separator] [-P name=value] file ...\n")
 		os.Exit(1)
 	}
 
-	for _, path := range args {
-		result, err := fi.IdentifyFile(path)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "file: %s: %v\n", path, err)
-			continue
+	identifyInOrder(fi, args, func(br magic.BatchResult) {
+		var result string
+		var limitErr *magic.LimitError
+		switch {
+		case errors.As(br.Err, &limitErr):
+			// Like file(1), report an exceeded limit in place of the type.
+			result = "ERROR: " + limitErr.Error()
+		case br.Err != nil:
+			fmt.Fprintf(os.Stderr, "file: %s: %v\n", br.Path, br.Err)
+			return
+		default:
+			result = fi.Format(br.Result)
 		}
 		if *brief {
 			fmt.Println(result)
 		} else {
-			fmt.Printf("%s%s %s\n", path, *separator, result)
+			fmt.Printf("%s%s %s\n", br.Path, *separator, result)
 		}
+	})
+}
+
+// identifyInOrder identifies paths concurrently and calls fn with each
+// result in input order, as soon as the results before it are done.
+func identifyInOrder(fi *magic.FileIdentifier, paths []string, fn func(magic.BatchResult)) {
+	in := make(chan string)
+	go func() {
+		defer close(in)
+		for _, p := range paths {
+			in <- p
+		}
+	}()
+	pending := make(map[int]magic.BatchResult)
+	next := 0
+	for br := range fi.IdentifyStream(context.Background(), in, magic.BatchOptions{}) {
+		pending[br.Index] = br
+		for {
+			br, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			fn(br)
+			next++
+		}
+	}
+}
+
+// writeSnapshot writes the magic rules of fi to a snapshot file at path.
+func writeSnapshot(fi *magic.FileIdentifier, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := fi.WriteSnapshot(f); err != nil {
+		_ = f.Close()
+		return err
 	}
+	return f.Close()
 }
@@ -3,6 +3,11 @@
 package gofile
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+
 	"github.com/shirou/gofile/internal/magic"
 )
 
@@ -10,21 +15,155 @@ import (
 type Options struct {
 	// MimeType outputs MIME type instead of description.
 	MimeType bool
+	// MimeEncoding outputs the charset (e.g. "utf-8", "binary") instead of
+	// description. Combined with MimeType, the output is "type; charset=...".
+	MimeEncoding bool
+	// Extension outputs the valid extensions for the identified type,
+	// separated by "/" (e.g. "jpeg/jpg/jpe/jfif"), or "???" if unknown.
+	Extension bool
+	// Apple outputs the 8-character Apple creator/type code of the
+	// identified type (e.g. "8BIMJPEG"), or "UNKNUNKN" if unknown.
+	Apple bool
+	// Mmap memory-maps regular files read-only instead of reading them.
+	// It is honored on Linux only and falls back to reading the file when
+	// mapping fails. A file truncated during identification yields an error.
+	Mmap bool
 	// Brief enables brief mode (no filename prefix).
 	Brief bool
+
+	// The evaluation limits below are file(1)'s -P parameters, named in
+	// parentheses. Zero selects file(1)'s default. Exceeding the indir or
+	// name limit fails identification with a *LimitError.
+
+	// IndirMax bounds the nesting of indirect rules (indir, default 50).
+	IndirMax int
+	// NameMax bounds the nesting of use of named rules (name, default 50).
+	NameMax int
+	// ElfNotesMax is the number of ELF notes examined (elf_notes, default 256).
+	ElfNotesMax int
+	// ElfPhnumMax is the number of ELF program headers examined; more are
+	// reported as "too many program" (elf_phnum, default 2048).
+	ElfPhnumMax int
+	// ElfShnumMax is the number of ELF section headers examined; more are
+	// reported as "too many section" (elf_shnum, default 32768).
+	ElfShnumMax int
+	// EncodingMax is the number of bytes examined to detect the text
+	// encoding (encoding, default 65536).
+	EncodingMax int
+	// RegexMax is the number of bytes a regex rule searches (regex,
+	// default 8192).
+	RegexMax int
+	// BytesMax is the largest number of bytes of a file read at once, as by
+	// a search rule without a range, and of a stream read by IdentifyReader
+	// (bytes, default 7 MiB).
+	BytesMax int
+}
+
+// SetParam sets the limit that file(1) calls name, as with file -P
+// name=value. The names are indir, name, elf_notes, elf_phnum, elf_shnum,
+// encoding, regex and bytes.
+func (o *Options) SetParam(name string, value int) error {
+	mo := o.toMagic()
+	if err := mo.SetParam(name, value); err != nil {
+		return err
+	}
+	o.IndirMax = mo.IndirMax
+	o.NameMax = mo.NameMax
+	o.ElfNotesMax = mo.ElfNotesMax
+	o.ElfPhnumMax = mo.ElfPhnumMax
+	o.ElfShnumMax = mo.ElfShnumMax
+	o.EncodingMax = mo.EncodingMax
+	o.RegexMax = mo.RegexMax
+	o.BytesMax = mo.BytesMax
+	return nil
+}
+
+func (o Options) toMagic() magic.Options {
+	return magic.Options{
+		MimeType:     o.MimeType,
+		MimeEncoding: o.MimeEncoding,
+		Extension:    o.Extension,
+		Apple:        o.Apple,
+		Mmap:         o.Mmap,
+		Brief:        o.Brief,
+		IndirMax:     o.IndirMax,
+		NameMax:      o.NameMax,
+		ElfNotesMax:  o.ElfNotesMax,
+		ElfPhnumMax:  o.ElfPhnumMax,
+		ElfShnumMax:  o.ElfShnumMax,
+		EncodingMax:  o.EncodingMax,
+		RegexMax:     o.RegexMax,
+		BytesMax:     o.BytesMax,
+	}
+}
+
+// LimitError reports that identifying an input exceeded an evaluation
+// limit. Its message is the one file(1) prints, such as
+// "indirect count (50) exceeded".
+type LimitError = magic.LimitError
+
+// Source identifies the identification phase that produced a Result.
+type Source uint8
+
+const (
+	SourceNone      Source = Source(magic.SourceNone)      // no identification was made
+	SourceFS        Source = Source(magic.SourceFS)        // filesystem metadata (directory, symlink, empty, ...)
+	SourceSoftMagic Source = Source(magic.SourceSoftMagic) // a binary magic rule
+	SourceJSON      Source = Source(magic.SourceJSON)      // JSON / NDJSON detection
+	SourceText      Source = Source(magic.SourceText)      // text detection, optionally refined by text magic rules
+	SourceELF       Source = Source(magic.SourceELF)       // a magic rule enriched with ELF header analysis
+	SourceData      Source = Source(magic.SourceData)      // nothing matched; generic "data"
+)
+
+// String returns the phase name.
+func (s Source) String() string {
+	return magic.Source(s).String()
+}
+
+// Result is the structured outcome of identifying a file.
+type Result struct {
+	// Desc is the human-readable description, as printed by file(1).
+	Desc string
+	// MimeType is the MIME type of the matched rule, if it has one.
+	MimeType string
+	// Encoding is the charset of the content (e.g. "us-ascii", "binary").
+	Encoding string
+	// Extensions lists the file extensions suggested by the matched rule.
+	Extensions []string
+	// Apple is the 8-character Apple creator/type code of the matched rule.
+	Apple string
+	// Strength is the strength of the matched top-level rule, 0 if no rule matched.
+	Strength int
+	// Source is the phase that produced the result.
+	Source Source
+}
+
+// String returns the description.
+func (r Result) String() string {
+	return r.Desc
+}
+
+func newResult(r magic.Result) Result {
+	return Result{
+		Desc:       r.Desc,
+		MimeType:   r.MimeType,
+		Encoding:   r.Encoding,
+		Extensions: r.Extensions,
+		Apple:      r.Apple,
+		Strength:   r.Strength,
+		Source:     Source(r.Source),
+	}
 }
 
 // FileIdentifier identifies file types using magic number rules.
+// A single FileIdentifier may be shared by any number of goroutines.
 type FileIdentifier struct {
 	fi *magic.FileIdentifier
 }
 
 // New creates a FileIdentifier using the embedded magic database.
 func New(opts Options) (*FileIdentifier, error) {
-	fi, err := magic.New(magic.Options{
-		MimeType: opts.MimeType,
-		Brief:    opts.Brief,
-	})
+	fi, err := magic.New(opts.toMagic())
 	if err != nil {
 		return nil, err
 	}
@@ -33,10 +172,7 @@ func New(opts Options) (*FileIdentifier, error) {
 
 // NewFromDir creates a FileIdentifier using magic files from the given directory.
 func NewFromDir(dir string, opts Options) (*FileIdentifier, error) {
-	fi, err := magic.NewFromDir(dir, magic.Options{
-		MimeType: opts.MimeType,
-		Brief:    opts.Brief,
-	})
+	fi, err := magic.NewFromDir(dir, opts.toMagic())
 	if err != nil {
 		return nil, err
 	}
@@ -45,23 +181,27 @@ func NewFromDir(dir string, opts Options) (*FileIdentifier, error) {
 
 // NewFromMgcFile creates a FileIdentifier from a compiled .mgc file.
 func NewFromMgcFile(path string, opts Options) (*FileIdentifier, error) {
-	fi, err := magic.NewFromMgcFile(path, magic.Options{
-		MimeType: opts.MimeType,
-		Brief:    opts.Brief,
-	})
+	fi, err := magic.NewFromMgcFile(path, opts.toMagic())
+	if err != nil {
+		return nil, err
+	}
+	return &FileIdentifier{fi: fi}, nil
+}
+
+// NewFromSnapshot creates a FileIdentifier from a snapshot file written by
+// WriteSnapshot. Loading a snapshot skips parsing the magic files.
+func NewFromSnapshot(path string, opts Options) (*FileIdentifier, error) {
+	fi, err := magic.NewFromSnapshot(path, opts.toMagic())
 	if err != nil {
 		return nil, err
 	}
 	return &FileIdentifier{fi: fi}, nil
 }
 
-// NewFromPath creates a FileIdentifier from a path that can be either
+// NewFromPath creates a FileIdentifier from a path that can be a snapshot,
 // a .mgc compiled file or a directory of text magic files.
 func NewFromPath(path string, opts Options) (*FileIdentifier, error) {
-	fi, err := magic.NewFromPath(path, magic.Options{
-		MimeType: opts.MimeType,
-		Brief:    opts.Brief,
-	})
+	fi, err := magic.NewFromPath(path, opts.toMagic())
 	if err != nil {
 		return nil, err
 	}
@@ -72,10 +212,7 @@ func NewFromPath(path string, opts Options) (*FileIdentifier, error) {
 // It searches localDir first (if non-empty), then system paths.
 // Falls back to the embedded database if no .mgc file is found.
 func NewFromSystemMgc(localDir string, opts Options) (*FileIdentifier, error) {
-	fi, err := magic.NewFromSystemMgc(localDir, magic.Options{
-		MimeType: opts.MimeType,
-		Brief:    opts.Brief,
-	})
+	fi, err := magic.NewFromSystemMgc(localDir, opts.toMagic())
 	if err != nil {
 		return nil, err
 	}
@@ -91,3 +228,227 @@ func (f *FileIdentifier) IdentifyFile(path string) (string, error) {
 func (f *FileIdentifier) IdentifyBuffer(buf []byte) string {
 	return f.fi.IdentifyBuffer(buf)
 }
+
+// IdentifyFileContext is like IdentifyFile but gives up and returns
+// ctx.Err() once ctx is canceled or its deadline passes.
+func (f *FileIdentifier) IdentifyFileContext(ctx context.Context, path string) (string, error) {
+	return f.fi.IdentifyFileContext(ctx, path)
+}
+
+// IdentifyBufferContext is like IdentifyBuffer but gives up and returns
+// ctx.Err() once ctx is canceled or its deadline passes.
+func (f *FileIdentifier) IdentifyBufferContext(ctx context.Context, buf []byte) (string, error) {
+	return f.fi.IdentifyBufferContext(ctx, buf)
+}
+
+// IdentifyFileResult identifies a file by its path and returns the structured result.
+func (f *FileIdentifier) IdentifyFileResult(path string) (Result, error) {
+	r, err := f.fi.IdentifyFileResult(path)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(r), nil
+}
+
+// IdentifyBufferResult identifies content from a byte buffer and returns the
+// structured result.
+func (f *FileIdentifier) IdentifyBufferResult(buf []byte) Result {
+	return newResult(f.fi.IdentifyBufferResult(buf))
+}
+
+// IdentifyReader identifies content read from r. Only the bytes the magic
+// rules read are consumed, at most Options.BytesMax; rules testing offsets
+// from the end, or offsets read from the content, may read that far.
+func (f *FileIdentifier) IdentifyReader(r io.Reader) (string, error) {
+	return f.fi.IdentifyReader(r)
+}
+
+// IdentifyReaderResult identifies content read from r and returns the
+// structured result.
+func (f *FileIdentifier) IdentifyReaderResult(r io.Reader) (Result, error) {
+	res, err := f.fi.IdentifyReaderResult(r)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(res), nil
+}
+
+// IdentifyReaderAt identifies size bytes of content available from r.
+// Random access allows ELF analysis and rules with large or indirect offsets
+// to work as they do for files on disk.
+func (f *FileIdentifier) IdentifyReaderAt(r io.ReaderAt, size int64) (string, error) {
+	return f.fi.IdentifyReaderAt(r, size)
+}
+
+// IdentifyReaderAtResult identifies size bytes of content available from r
+// and returns the structured result.
+func (f *FileIdentifier) IdentifyReaderAtResult(r io.ReaderAt, size int64) (Result, error) {
+	res, err := f.fi.IdentifyReaderAtResult(r, size)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(res), nil
+}
+
+// Format renders a Result the way IdentifyFile prints it for the
+// FileIdentifier's options (description, MIME type, extensions, ...).
+func (f *FileIdentifier) Format(r Result) string {
+	return f.fi.Format(magic.Result{
+		Desc:       r.Desc,
+		MimeType:   r.MimeType,
+		Encoding:   r.Encoding,
+		Extensions: r.Extensions,
+		Apple:      r.Apple,
+		Strength:   r.Strength,
+		Source:     magic.Source(r.Source),
+	})
+}
+
+// WriteSnapshot writes the loaded magic rules to w in gofile's versioned
+// snapshot format, which preserves every field of every rule. Load it with
+// NewFromSnapshot or NewFromPath.
+func (f *FileIdentifier) WriteSnapshot(w io.Writer) error {
+	return f.fi.WriteSnapshot(w)
+}
+
+// Diagnostic is a problem in a magic file found while loading it, such as a
+// regex pattern that does not compile. The affected rule never matches.
+type Diagnostic struct {
+	File string
+	Line int
+	Msg  string
+}
+
+// String formats the diagnostic the way file(1) prints magic warnings.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s, %d: Warning: %s", d.File, d.Line, d.Msg)
+}
+
+// Diagnostics returns the problems found while loading the magic rules.
+func (f *FileIdentifier) Diagnostics() []Diagnostic {
+	var diags []Diagnostic
+	for _, d := range f.fi.Diagnostics() {
+		diags = append(diags, Diagnostic(d))
+	}
+	return diags
+}
+
+// BatchOptions controls batch identification.
+type BatchOptions struct {
+	// Workers is the number of files identified concurrently.
+	// Zero or negative means runtime.GOMAXPROCS(0).
+	Workers int
+}
+
+// BatchResult is the outcome of identifying one path of a batch.
+type BatchResult struct {
+	// Index is the position of Path in the input.
+	Index int
+	Path  string
+	// Result is the identification; it is zero when Err is set.
+	Result Result
+	Err    error
+}
+
+func newBatchResult(br magic.BatchResult) BatchResult {
+	return BatchResult{
+		Index:  br.Index,
+		Path:   br.Path,
+		Result: newResult(br.Result),
+		Err:    br.Err,
+	}
+}
+
+// IdentifyBatch identifies paths concurrently and returns one BatchResult
+// per path, in input order. Once ctx is canceled, the remaining paths are
+// reported with ctx.Err().
+func (f *FileIdentifier) IdentifyBatch(ctx context.Context, paths []string, opts BatchOptions) []BatchResult {
+	results := f.fi.IdentifyBatch(ctx, paths, magic.BatchOptions{Workers: opts.Workers})
+	out := make([]BatchResult, len(results))
+	for i, br := range results {
+		out[i] = newBatchResult(br)
+	}
+	return out
+}
+
+// IdentifyStream identifies the paths received from paths concurrently and
+// sends their results, as they complete, on the returned channel. Index is
+// the position at which a path was received. The channel is closed once
+// paths is closed, or ctx is canceled, and all started items are reported;
+// the caller must drain it.
+func (f *FileIdentifier) IdentifyStream(ctx context.Context, paths <-chan string, opts BatchOptions) <-chan BatchResult {
+	results := f.fi.IdentifyStream(ctx, paths, magic.BatchOptions{Workers: opts.Workers})
+	out := make(chan BatchResult, cap(results))
+	go func() {
+		defer close(out)
+		for br := range results {
+			out <- newBatchResult(br)
+		}
+	}()
+	return out
+}
+
+// WalkOptions controls recursive identification.
+type WalkOptions struct {
+	// FollowSymlinks identifies the targets of symbolic links, and descends
+	// into linked directories, instead of reporting the links themselves.
+	FollowSymlinks bool
+	// SkipHidden skips files and directories whose name starts with ".".
+	SkipHidden bool
+	// Include, if non-empty, limits the reported entries to those matching
+	// at least one path.Match pattern. Patterns containing "/" are matched
+	// against the path relative to the root, others against the base name.
+	// Directories are still descended into.
+	Include []string
+	// Exclude skips entries matching any pattern; excluded directories are
+	// not descended into.
+	Exclude []string
+	// MaxDepth limits how deep below the root the walk descends; the root
+	// is at depth 0 and its entries at depth 1. Zero means unlimited.
+	MaxDepth int
+	// MaxSize skips regular files larger than MaxSize bytes. Zero means unlimited.
+	MaxSize int64
+}
+
+func (o WalkOptions) toMagic() magic.WalkOptions {
+	return magic.WalkOptions{
+		FollowSymlinks: o.FollowSymlinks,
+		SkipHidden:     o.SkipHidden,
+		Include:        o.Include,
+		Exclude:        o.Exclude,
+		MaxDepth:       o.MaxDepth,
+		MaxSize:        o.MaxSize,
+	}
+}
+
+// WalkResult is the outcome of identifying one entry of a walk.
+type WalkResult struct {
+	Path   string
+	Result Result
+	// Err is the error opening, reading or listing the entry, if any.
+	Err error
+}
+
+// WalkFunc is called for each entry of a walk. Returning fs.SkipAll stops
+// the walk without error, fs.SkipDir skips the remaining entries of the
+// directory being listed, and any other non-nil error stops the walk and
+// is returned.
+type WalkFunc func(WalkResult) error
+
+func (fn WalkFunc) toMagic() magic.WalkFunc {
+	return func(wr magic.WalkResult) error {
+		return fn(WalkResult{Path: wr.Path, Result: newResult(wr.Result), Err: wr.Err})
+	}
+}
+
+// Walk identifies root and, if it is a directory, everything below it, in
+// lexical order, calling fn for each entry. Reported paths start with root.
+func (f *FileIdentifier) Walk(ctx context.Context, root string, opts WalkOptions, fn WalkFunc) error {
+	return f.fi.Walk(ctx, root, opts.toMagic(), fn.toMagic())
+}
+
+// WalkFS is like Walk for the tree rooted at root in fsys, which may be an
+// embed.FS, a *zip.Reader, an fstest.MapFS or any other fs.FS.
+func (f *FileIdentifier) WalkFS(ctx context.Context, fsys fs.FS, root string, opts WalkOptions, fn WalkFunc) error {
+	return f.fi.WalkFS(ctx, fsys, root, opts.toMagic(), fn.toMagic())
+}
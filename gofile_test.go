@@ -1,7 +1,16 @@
 package gofile
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestIdentifyFile(t *testing.T) {
@@ -62,3 +71,467 @@ func TestIdentifyFile_Directory(t *testing.T) {
 		t.Errorf("expected 'directory', got %q", result)
 	}
 }
+
+func TestIdentifyFileResult(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	result, err := fi.IdentifyFileResult("testdata/test.pdf")
+	if err != nil {
+		t.Fatalf("IdentifyFileResult() error: %v", err)
+	}
+	if result.Source != SourceSoftMagic {
+		t.Errorf("Source = %v, want %v", result.Source, SourceSoftMagic)
+	}
+	if result.MimeType != "application/pdf" {
+		t.Errorf("MimeType = %q, want %q", result.MimeType, "application/pdf")
+	}
+	if result.Strength == 0 {
+		t.Error("Strength = 0, want non-zero for a magic match")
+	}
+
+	result, err = fi.IdentifyFileResult("testdata")
+	if err != nil {
+		t.Fatalf("IdentifyFileResult() error: %v", err)
+	}
+	if result.Desc != "directory" || result.Source != SourceFS {
+		t.Errorf("got %q from %v, want \"directory\" from %v", result.Desc, result.Source, SourceFS)
+	}
+}
+
+func TestIdentifyFile_MimeType(t *testing.T) {
+	fi, err := New(Options{MimeType: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"testdata/test.pdf", "application/pdf"},
+		{"testdata/empty", "inode/x-empty"},
+		{"testdata", "inode/directory"},
+	}
+	for _, tt := range tests {
+		result, err := fi.IdentifyFile(tt.path)
+		if err != nil {
+			t.Fatalf("IdentifyFile(%q) error: %v", tt.path, err)
+		}
+		if result != tt.want {
+			t.Errorf("IdentifyFile(%q) = %q, want %q", tt.path, result, tt.want)
+		}
+	}
+}
+
+func TestIdentifyFile_MimeEncoding(t *testing.T) {
+	tests := []struct {
+		opts Options
+		path string
+		want string
+	}{
+		{Options{MimeEncoding: true}, "testdata/test.pdf", "us-ascii"},
+		{Options{MimeEncoding: true}, "testdata", "binary"},
+		{Options{MimeType: true, MimeEncoding: true}, "testdata/test.pdf", "application/pdf; charset=us-ascii"},
+		{Options{MimeType: true, MimeEncoding: true}, "testdata/empty", "inode/x-empty; charset=binary"},
+	}
+	for _, tt := range tests {
+		fi, err := New(tt.opts)
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+		result, err := fi.IdentifyFile(tt.path)
+		if err != nil {
+			t.Fatalf("IdentifyFile(%q) error: %v", tt.path, err)
+		}
+		if result != tt.want {
+			t.Errorf("IdentifyFile(%q) = %q, want %q", tt.path, result, tt.want)
+		}
+	}
+}
+
+func TestIdentifyBuffer_MimeEncoding(t *testing.T) {
+	fi, err := New(Options{MimeType: true, MimeEncoding: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	result := fi.IdentifyBuffer([]byte("hello world\n"))
+	if want := "text/plain; charset=us-ascii"; result != want {
+		t.Errorf("IdentifyBuffer() = %q, want %q", result, want)
+	}
+}
+
+func TestIdentifyFile_Extension(t *testing.T) {
+	fi, err := New(Options{Extension: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"testdata/test.pdf", "pdf"},
+		{"testdata", "???"},
+	}
+	for _, tt := range tests {
+		result, err := fi.IdentifyFile(tt.path)
+		if err != nil {
+			t.Fatalf("IdentifyFile(%q) error: %v", tt.path, err)
+		}
+		if result != tt.want {
+			t.Errorf("IdentifyFile(%q) = %q, want %q", tt.path, result, tt.want)
+		}
+	}
+}
+
+func TestIdentifyBuffer_Apple(t *testing.T) {
+	fi, err := New(Options{Apple: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	tests := []struct {
+		buf  []byte
+		want string
+	}{
+		{[]byte("GIF89a\x01\x00\x01\x00\x80\x00\x00"), "8BIMGIFf"},
+		{[]byte("plain text\n"), "UNKNUNKN"},
+	}
+	for _, tt := range tests {
+		if got := fi.IdentifyBuffer(tt.buf); got != tt.want {
+			t.Errorf("IdentifyBuffer(%q) = %q, want %q", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestIdentifyReader(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	pdf, err := os.ReadFile("testdata/test.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fi.IdentifyBuffer(pdf)
+	got, err := fi.IdentifyReader(bytes.NewReader(pdf))
+	if err != nil {
+		t.Fatalf("IdentifyReader() error: %v", err)
+	}
+	if got != want {
+		t.Errorf("IdentifyReader() = %q, want %q", got, want)
+	}
+
+	// The default rules include tests at offsets from the end of the input,
+	// which read a long stream up to the bytes limit and no further.
+	const bytesMax = 7 << 20
+	r := bytes.NewReader(append(pdf, make([]byte, 3*bytesMax)...))
+	if got, err := fi.IdentifyReader(r); err != nil || got != want {
+		t.Fatalf("IdentifyReader() on a long stream = %q, %v, want %q", got, err, want)
+	}
+	if consumed := r.Size() - int64(r.Len()); consumed != bytesMax {
+		t.Errorf("IdentifyReader() consumed %d bytes, want %d", consumed, bytesMax)
+	}
+	// BytesMax bounds what is consumed.
+	fi, err = New(Options{BytesMax: 1 << 20})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	r.Reset(append(pdf, make([]byte, 3*bytesMax)...))
+	if _, err := fi.IdentifyReader(r); err != nil {
+		t.Fatalf("IdentifyReader() error: %v", err)
+	}
+	if consumed := r.Size() - int64(r.Len()); consumed != 1<<20 {
+		t.Errorf("IdentifyReader() with BytesMax 1 MiB consumed %d bytes, want %d", consumed, 1<<20)
+	}
+}
+
+func TestIdentifyReaderAt(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	// The test binary itself exercises ELF analysis on platforms that use ELF.
+	for _, path := range []string{"testdata/test.pdf", os.Args[0]} {
+		want, err := fi.IdentifyFile(path)
+		if err != nil {
+			t.Fatalf("IdentifyFile(%q) error: %v", path, err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fi.IdentifyReaderAt(f, info.Size())
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("IdentifyReaderAt(%q) error: %v", path, err)
+		}
+		if got != want {
+			t.Errorf("IdentifyReaderAt(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	got, err := fi.IdentifyReaderAt(strings.NewReader(""), 0)
+	if err != nil {
+		t.Fatalf("IdentifyReaderAt(empty) error: %v", err)
+	}
+	if got != "empty" {
+		t.Errorf("IdentifyReaderAt(empty) = %q, want %q", got, "empty")
+	}
+}
+
+func TestFileIdentifier_Concurrent(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	paths := []string{"testdata/test.pdf", "testdata/empty", "testdata", os.Args[0]}
+	bufs := [][]byte{
+		[]byte("GIF89a\x01\x00\x01\x00\x80\x00\x00"),
+		[]byte(`{"key": "value"}`),
+		[]byte("#!/bin/sh\necho hello\n"),
+		{0x00, 0x01, 0x02, 0x03},
+	}
+	wantFile := make([]string, len(paths))
+	for i, path := range paths {
+		if wantFile[i], err = fi.IdentifyFile(path); err != nil {
+			t.Fatalf("IdentifyFile(%q) error: %v", path, err)
+		}
+	}
+	wantBuf := make([]string, len(bufs))
+	for i, buf := range bufs {
+		wantBuf[i] = fi.IdentifyBuffer(buf)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				k := (g + i) % len(paths)
+				got, err := fi.IdentifyFile(paths[k])
+				if err != nil || got != wantFile[k] {
+					t.Errorf("IdentifyFile(%q) = %q, %v, want %q", paths[k], got, err, wantFile[k])
+					return
+				}
+				k = (g + i) % len(bufs)
+				if got := fi.IdentifyBuffer(bufs[k]); got != wantBuf[k] {
+					t.Errorf("IdentifyBuffer(%q) = %q, want %q", bufs[k], got, wantBuf[k])
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestIdentifyContext(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	got, err := fi.IdentifyFileContext(context.Background(), "testdata/test.pdf")
+	if err != nil {
+		t.Fatalf("IdentifyFileContext() error: %v", err)
+	}
+	if want, _ := fi.IdentifyFile("testdata/test.pdf"); got != want {
+		t.Errorf("IdentifyFileContext() = %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fi.IdentifyFileContext(ctx, "testdata/test.pdf"); err != context.Canceled {
+		t.Errorf("IdentifyFileContext(canceled) err = %v, want %v", err, context.Canceled)
+	}
+	if _, err := fi.IdentifyBufferContext(ctx, []byte("hello\n")); err != context.Canceled {
+		t.Errorf("IdentifyBufferContext(canceled) err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestIdentifyBufferContext_Deadline(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	// A large text buffer makes every search and regex rule scan its full range.
+	buf := bytes.Repeat([]byte("lorem ipsum dolor sit amet\n"), 40000)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = fi.IdentifyBufferContext(ctx, buf)
+	if err != context.DeadlineExceeded {
+		t.Skipf("identification finished before the deadline (err = %v)", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("IdentifyBufferContext took %v with a 1ms deadline", elapsed)
+	}
+}
+
+func TestIdentifyBatch(t *testing.T) {
+	fi, err := New(Options{MimeType: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	paths := []string{"testdata/test.pdf", "testdata/missing", "testdata/empty", "testdata"}
+	results := fi.IdentifyBatch(context.Background(), paths, BatchOptions{Workers: 2})
+	if len(results) != len(paths) {
+		t.Fatalf("got %d results, want %d", len(results), len(paths))
+	}
+	for i, br := range results {
+		if br.Index != i || br.Path != paths[i] {
+			t.Errorf("result %d is for (%d, %q)", i, br.Index, br.Path)
+		}
+		if paths[i] == "testdata/missing" {
+			if br.Err == nil {
+				t.Error("missing file: expected an error")
+			}
+			continue
+		}
+		want, err := fi.IdentifyFile(paths[i])
+		if err != nil {
+			t.Fatalf("IdentifyFile(%q) error: %v", paths[i], err)
+		}
+		if got := fi.Format(br.Result); br.Err != nil || got != want {
+			t.Errorf("%s = %q, %v, want %q", paths[i], got, br.Err, want)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	got := make(map[string]string)
+	err = fi.Walk(context.Background(), "testdata", WalkOptions{Include: []string{"*.pdf"}}, func(wr WalkResult) error {
+		if wr.Err != nil {
+			t.Errorf("%s: %v", wr.Path, wr.Err)
+		}
+		got[wr.Path] = wr.Result.Desc
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error: %v", err)
+	}
+	want, _ := fi.IdentifyFile("testdata/test.pdf")
+	if len(got) != 1 || got["testdata/test.pdf"] != want {
+		t.Errorf("Walk() reported %v, want only testdata/test.pdf: %q", got, want)
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "magic.snap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fi.WriteSnapshot(f); err != nil {
+		t.Fatalf("WriteSnapshot() error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewFromSnapshot(path, Options{})
+	if err != nil {
+		t.Fatalf("NewFromSnapshot() error: %v", err)
+	}
+	for _, buf := range [][]byte{
+		[]byte("%PDF-1.4 test"),
+		[]byte("#!/bin/sh\necho hello\n"),
+		[]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\x00\x10\x00\x00\x00\x10\x08\x02\x00\x00\x00"),
+	} {
+		if got, want := loaded.IdentifyBuffer(buf), fi.IdentifyBuffer(buf); got != want {
+			t.Errorf("IdentifyBuffer(%q) from snapshot = %q, want %q", buf, got, want)
+		}
+	}
+	if got, want := len(loaded.Diagnostics()), len(fi.Diagnostics()); got != want {
+		t.Errorf("snapshot has %d diagnostics, want %d", got, want)
+	}
+
+	if _, err := NewFromSnapshot("testdata/test.pdf", Options{}); err == nil {
+		t.Error("NewFromSnapshot() of a PDF file succeeded")
+	}
+}
+
+func TestOptions_ToMagic(t *testing.T) {
+	// Set every field to a distinct non-zero value.
+	var o Options
+	ov := reflect.ValueOf(&o).Elem()
+	for i := range ov.NumField() {
+		switch f := ov.Field(i); f.Kind() {
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int:
+			f.SetInt(int64(i + 1))
+		default:
+			t.Fatalf("Options.%s: unhandled kind %s", ov.Type().Field(i).Name, f.Kind())
+		}
+	}
+
+	mv := reflect.ValueOf(o.toMagic())
+	if mv.NumField() != ov.NumField() {
+		t.Errorf("magic.Options has %d fields, Options has %d", mv.NumField(), ov.NumField())
+	}
+	for i := range ov.NumField() {
+		name := ov.Type().Field(i).Name
+		if got, want := mv.FieldByName(name), ov.Field(i); !got.IsValid() || !got.Equal(want) {
+			t.Errorf("toMagic: %s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	dir := t.TempDir()
+	magicDir := filepath.Join(dir, "magic")
+	if err := os.Mkdir(magicDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(magicDir, "loop"), []byte("0\tstring\tLOOP\tloop\n>0\tindirect\tx\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, []byte("LOOP"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts Options
+	if err := opts.SetParam("indir", 3); err != nil {
+		t.Fatalf("SetParam() error: %v", err)
+	}
+	if opts.IndirMax != 3 {
+		t.Errorf("IndirMax = %d, want 3", opts.IndirMax)
+	}
+	if err := opts.SetParam("nosuch", 3); err == nil {
+		t.Error("SetParam() of an unknown param succeeded")
+	}
+
+	fi, err := NewFromDir(magicDir, opts)
+	if err != nil {
+		t.Fatalf("NewFromDir() error: %v", err)
+	}
+	_, err = fi.IdentifyFile(input)
+	var le *LimitError
+	if !errors.As(err, &le) || le.Param != "indir" || le.Limit != 3 {
+		t.Errorf("IdentifyFile() error = %v, want indir LimitError with limit 3", err)
+	}
+}
@@ -0,0 +1,110 @@
+package magic
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// BatchOptions controls batch identification.
+type BatchOptions struct {
+	// Workers is the number of files identified concurrently.
+	// Zero or negative means runtime.GOMAXPROCS(0).
+	Workers int
+}
+
+func (o BatchOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// BatchResult is the outcome of identifying one path of a batch.
+type BatchResult struct {
+	Index  int // position of Path in the input
+	Path   string
+	Result Result
+	Err    error // per-item error; Result is zero when set
+}
+
+// IdentifyBatch identifies paths concurrently and returns one BatchResult per
+// path, in input order. All workers share the FileIdentifier's rule set and
+// a pool of read buffers. Once ctx is canceled, the remaining paths are
+// reported with ctx.Err().
+func (fi *FileIdentifier) IdentifyBatch(ctx context.Context, paths []string, opts BatchOptions) []BatchResult {
+	results := make([]BatchResult, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := min(opts.workers(), len(paths)); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = fi.identifyBatchItem(ctx, i, paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// IdentifyStream identifies the paths received from paths concurrently and
+// sends their results, in completion order, on the returned channel. Index
+// is the position at which a path was received. The channel is closed once
+// paths is closed, or ctx is canceled, and all started items are reported;
+// the caller must drain it.
+func (fi *FileIdentifier) IdentifyStream(ctx context.Context, paths <-chan string, opts BatchOptions) <-chan BatchResult {
+	type job struct {
+		index int
+		path  string
+	}
+	workers := opts.workers()
+	jobs := make(chan job)
+	out := make(chan BatchResult, workers)
+
+	go func() {
+		defer close(jobs)
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case path, ok := <-paths:
+				if !ok {
+					return
+				}
+				jobs <- job{i, path}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				out <- fi.identifyBatchItem(ctx, j.index, j.path)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func (fi *FileIdentifier) identifyBatchItem(ctx context.Context, index int, path string) BatchResult {
+	br := BatchResult{Index: index, Path: path}
+	if err := ctx.Err(); err != nil {
+		br.Err = err
+		return br
+	}
+	br.Result, br.Err = fi.identifyFile(ctx, path)
+	return br
+}
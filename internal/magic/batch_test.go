@@ -0,0 +1,119 @@
+package magic
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func newBatchTestIdentifier(t *testing.T) *FileIdentifier {
+	t.Helper()
+	fi, err := NewFromFS(fstest.MapFS{
+		"test": {Data: []byte("0\tstring\t%PDF-\tPDF document\n0\tstring\tGIF8\tGIF image data\n")},
+	}, Options{})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+	return fi
+}
+
+func writeBatchFiles(t *testing.T) (paths, want []string) {
+	t.Helper()
+	dir := t.TempDir()
+	contents := map[string]string{
+		"a.pdf": "%PDF-1.4\n",
+		"b.gif": "GIF89a",
+		"c.txt": "hello\n",
+	}
+	descs := map[string]string{
+		"a.pdf": "PDF document",
+		"b.gif": "GIF image data",
+		"c.txt": "ASCII text",
+	}
+	for i := 0; i < 30; i++ {
+		for _, name := range []string{"a.pdf", "b.gif", "c.txt"} {
+			path := filepath.Join(dir, name)
+			if i == 0 {
+				if err := os.WriteFile(path, []byte(contents[name]), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			paths = append(paths, path)
+			want = append(want, descs[name])
+		}
+	}
+	return paths, want
+}
+
+func TestIdentifyBatch(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	paths, want := writeBatchFiles(t)
+	paths = append(paths, filepath.Join(t.TempDir(), "missing"))
+
+	for _, workers := range []int{0, 1, 4} {
+		results := fi.IdentifyBatch(context.Background(), paths, BatchOptions{Workers: workers})
+		if len(results) != len(paths) {
+			t.Fatalf("workers=%d: got %d results, want %d", workers, len(results), len(paths))
+		}
+		for i, br := range results {
+			if br.Index != i || br.Path != paths[i] {
+				t.Errorf("workers=%d: result %d is for (%d, %q)", workers, i, br.Index, br.Path)
+			}
+			if i == len(paths)-1 {
+				if br.Err == nil {
+					t.Errorf("workers=%d: missing file: expected an error", workers)
+				}
+				continue
+			}
+			if br.Err != nil || br.Result.Desc != want[i] {
+				t.Errorf("workers=%d: %s = %q, %v, want %q", workers, br.Path, br.Result.Desc, br.Err, want[i])
+			}
+		}
+	}
+}
+
+func TestIdentifyBatch_Canceled(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	paths, _ := writeBatchFiles(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, br := range fi.IdentifyBatch(ctx, paths, BatchOptions{Workers: 2}) {
+		if br.Err != context.Canceled {
+			t.Errorf("%s: err = %v, want %v", br.Path, br.Err, context.Canceled)
+		}
+	}
+}
+
+func TestIdentifyStream(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	paths, want := writeBatchFiles(t)
+
+	in := make(chan string)
+	go func() {
+		for _, p := range paths {
+			in <- p
+		}
+		close(in)
+	}()
+
+	seen := make([]bool, len(paths))
+	for br := range fi.IdentifyStream(context.Background(), in, BatchOptions{Workers: 3}) {
+		if br.Index < 0 || br.Index >= len(paths) || seen[br.Index] {
+			t.Fatalf("unexpected or duplicate index %d", br.Index)
+		}
+		seen[br.Index] = true
+		if br.Path != paths[br.Index] {
+			t.Errorf("result %d: path %q, want %q", br.Index, br.Path, paths[br.Index])
+		}
+		if br.Err != nil || br.Result.Desc != want[br.Index] {
+			t.Errorf("%s = %q, %v, want %q", br.Path, br.Result.Desc, br.Err, want[br.Index])
+		}
+	}
+	for i, ok := range seen {
+		if !ok {
+			t.Errorf("no result for %s (index %d)", paths[i], i)
+		}
+	}
+}
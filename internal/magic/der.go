@@ -0,0 +1,196 @@
+package magic
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The der type tests one DER (ASN.1) element, as file(1)'s der.c does. The
+// test value names the element's tag, optionally followed by its content
+// length and, after '=', its content: "seq", "int3=010001", "obj_id9=x".
+// Only the low five bits of the identifier are compared, so a
+// context-specific [0] element has the tag name "eoc".
+//
+// A matched element sets the offset of its level to the start of its
+// contents, so that &0 continuations read its first child, and moves the
+// offset of the parent level past the element, so that the next &0
+// sibling reads the element that follows it.
+
+const derBad = -1
+
+// derTagNames are the names of the universal tags, indexed by tag number.
+var derTagNames = [...]string{
+	"eoc", "bool", "int", "bit_str", "octet_str",
+	"null", "obj_id", "obj_desc", "ext", "real",
+	"enum", "embed", "utf8_str", "rel_oid", "time",
+	"res2", "seq", "set", "num_str", "prt_str",
+	"t61_str", "vid_str", "ia5_str", "utc_time", "gen_time",
+	"gr_str", "vis_str", "gen_str", "univ_str", "char_str",
+	"bmp_str", "date", "tod", "datetime", "duration",
+	"oid-iri", "rel-oid-iri",
+}
+
+// Universal tags whose contents are printed as text.
+const (
+	derUTF8String      = 12
+	derPrintableString = 19
+	derIA5String       = 22
+	derUTCTime         = 23
+)
+
+// derValueMax bounds the formatted contents of an element, like the
+// buffer der.c formats them into.
+const derValueMax = 127
+
+// derReadSize is the number of bytes read at the offset of a der test:
+// enough for the identifier, the length and the contents that are
+// compared or printed.
+const derReadSize = 1024
+
+// derTag reads the tag number at b[*p], advancing *p. l is the number of
+// bytes that belong to the input. Like der.c, it keeps the 0x1f of a
+// high tag number and does not consume its last byte.
+func derTag(b []byte, p *int, l int) int {
+	if *p >= l || *p >= len(b) {
+		return derBad
+	}
+	tag := int(b[*p] & 0x1f)
+	*p++
+	if tag != 0x1f {
+		return tag
+	}
+	if *p >= l || *p >= len(b) {
+		return derBad
+	}
+	for b[*p] >= 0x80 {
+		tag = tag*128 + int(b[*p]) - 0x80
+		*p++
+		if *p >= l || *p >= len(b) || tag > 1<<24 {
+			return derBad
+		}
+	}
+	return tag
+}
+
+// derLength reads the content length at b[*p], advancing *p. The length
+// must fit in the l bytes of the input; like der.c, short-form contents
+// must also end before the end of the input.
+func derLength(b []byte, p *int, l int) int {
+	if *p >= l || *p >= len(b) {
+		return derBad
+	}
+	oneByte := b[*p]&0x80 == 0
+	digits := int(b[*p] & 0x7f)
+	*p++
+	if *p+digits >= l {
+		return derBad
+	}
+	if oneByte {
+		return digits
+	}
+	if *p+digits > len(b) {
+		return derBad
+	}
+	n := 0
+	for range digits {
+		n = n<<8 | int(b[*p])
+		*p++
+		if n > l {
+			return derBad
+		}
+	}
+	if *p+n > l {
+		return derBad
+	}
+	return n
+}
+
+// derTagName returns the name a der test uses for tag.
+func derTagName(tag int) string {
+	if tag < len(derTagNames) {
+		return derTagNames[tag]
+	}
+	return fmt.Sprintf("%#x", tag)
+}
+
+// derData formats the contents d of an element with the given tag: text
+// for strings, a date for UTC times and hex digits otherwise.
+func derData(tag int, d []byte) string {
+	switch tag {
+	case derPrintableString, derUTF8String, derIA5String:
+		// der.c prints these with %.*s, which stops at a NUL.
+		if i := bytes.IndexByte(d, 0); i >= 0 {
+			d = d[:i]
+		}
+		return string(d[:min(len(d), derValueMax)])
+	case derUTCTime:
+		if len(d) >= 12 {
+			return fmt.Sprintf("20%s-%s-%s %s:%s:%s GMT", d[0:2], d[2:4], d[4:6], d[6:8], d[8:10], d[10:12])
+		}
+	}
+	return fmt.Sprintf("%x", d[:min(len(d), derValueMax/2)])
+}
+
+// matchDER tests the DER element at the start of b, of which l bytes
+// belong to the input, against test. It returns the length of the
+// element's identifier and length octets, the length of its contents and
+// the formatted contents if test compares them.
+func matchDER(b []byte, l int, test string) (hdr, n int, val string, ok bool) {
+	p := 0
+	tag := derTag(b, &p, l)
+	if tag == derBad {
+		return 0, 0, "", false
+	}
+	n = derLength(b, &p, l)
+	if n == derBad {
+		return 0, 0, "", false
+	}
+	name := derTagName(tag)
+	if !strings.HasPrefix(test, name) {
+		return 0, 0, "", false
+	}
+	s := test[len(name):]
+	for {
+		switch {
+		case s == "":
+			return p, n, "", true
+		case s[0] == '=':
+			d := b[p:min(p+n, len(b))]
+			if len(d) < min(n, derValueMax) {
+				return 0, 0, "", false // past the bytes read
+			}
+			val = derData(tag, d)
+			if s[1:] != "x" && val != s[1:] {
+				return 0, 0, "", false
+			}
+			return p, n, val, true
+		case s[0] >= '0' && s[0] <= '9':
+			want := 0
+			for s != "" && s[0] >= '0' && s[0] <= '9' {
+				want = want*10 + int(s[0]-'0')
+				s = s[1:]
+			}
+			if want != n {
+				return 0, 0, "", false
+			}
+		default:
+			return 0, 0, "", false
+		}
+	}
+}
+
+// tryMatchDER matches a der entry at offset. The returned offset is the
+// start of the element's contents; the returned Value holds the formatted
+// contents in Str and the offset just past the element in Numeric.
+func (s *matchState) tryMatchDER(buf []byte, offset int, entry *MagicEntry) (bool, Value, int) {
+	data, dataOff := s.window(buf, offset, derReadSize)
+	if dataOff >= len(data) {
+		return false, Value{}, 0
+	}
+	hdr, n, val, ok := matchDER(data[dataOff:], s.inputLen(buf)-offset, string(entry.Value.Str))
+	if !ok {
+		return false, Value{}, 0
+	}
+	return true, Value{Str: []byte(val), IsString: true, Numeric: uint64(offset + hdr + n)}, offset + hdr
+}
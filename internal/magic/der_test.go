@@ -0,0 +1,125 @@
+package magic
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchDER(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		test    string
+		wantOK  bool
+		wantHdr int
+		wantN   int
+		wantVal string
+	}{
+		{"seq", []byte{0x30, 0x03, 0x02, 0x01, 0x00, 0xff}, "seq", true, 2, 3, ""},
+		{"wrong tag", []byte{0x30, 0x03, 0x02, 0x01, 0x00, 0xff}, "set", false, 0, 0, ""},
+		{"length", []byte{0x02, 0x03, 0x01, 0x00, 0x01, 0xff}, "int3", true, 2, 3, ""},
+		{"wrong length", []byte{0x02, 0x03, 0x01, 0x00, 0x01, 0xff}, "int2", false, 0, 0, ""},
+		{"value", []byte{0x02, 0x03, 0x01, 0x00, 0x01, 0xff}, "int3=010001", true, 2, 3, "010001"},
+		{"wrong value", []byte{0x02, 0x03, 0x01, 0x00, 0x01, 0xff}, "int3=010002", false, 0, 0, ""},
+		{"any value", []byte{0x02, 0x02, 0x0d, 0xfa, 0xff}, "int2=x", true, 2, 2, "0dfa"},
+		{"value without length", []byte{0x02, 0x01, 0x02, 0xff}, "int=02", true, 2, 1, "02"},
+		{"context tag is eoc", []byte{0xa0, 0x03, 0x02, 0x01, 0x02, 0xff}, "eoc", true, 2, 3, ""},
+		{"long form length", append([]byte{0x04, 0x81, 0x80}, make([]byte, 0x81)...), "octet_str128", true, 3, 128, ""},
+		{"string", []byte{0x13, 0x02, 'U', 'S', 0xff}, "prt_str=x", true, 2, 2, "US"},
+		{"utf8 string", []byte{0x0c, 0x03, 'a', 0, 'b', 0xff}, "utf8_str=a", true, 2, 3, "a"},
+		{"high tag", []byte{0x1f, 0x81, 0x00, 0x00, 0xff}, "0x8f", false, 0, 0, ""},
+		{"high tag name", []byte{0x1f, 0x81, 0x00, 0x00, 0xff}, "0xf81", true, 3, 0, ""},
+		{"contents reach end", []byte{0x02, 0x01, 0x00}, "int", false, 0, 0, ""},
+		{"contents past end", []byte{0x02, 0x05, 0x00}, "int", false, 0, 0, ""},
+		{"long length past end", []byte{0x04, 0x82, 0x01, 0x00, 0x00}, "octet_str", false, 0, 0, ""},
+		{"trailing garbage", []byte{0x30, 0x00, 0xff}, "seqx", false, 0, 0, ""},
+		{"empty", nil, "seq", false, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		hdr, n, val, ok := matchDER(tt.b, len(tt.b), tt.test)
+		if ok != tt.wantOK || hdr != tt.wantHdr || n != tt.wantN || val != tt.wantVal {
+			t.Errorf("%s: matchDER(%q) = %d, %d, %q, %v, want %d, %d, %q, %v",
+				tt.name, tt.test, hdr, n, val, ok, tt.wantHdr, tt.wantN, tt.wantVal, tt.wantOK)
+		}
+	}
+}
+
+func TestDERData_UTCTime(t *testing.T) {
+	if got, want := derData(derUTCTime, []byte("240102030405Z")), "2024-01-02 03:04:05 GMT"; got != want {
+		t.Errorf("derData = %q, want %q", got, want)
+	}
+	if got, want := derData(derUTCTime, []byte("2401")), "32343031"; got != want {
+		t.Errorf("derData of a short time = %q, want %q", got, want)
+	}
+}
+
+// testRSAKey returns a key for building DER samples. 1024 bits keeps the
+// tests fast and selects the "1024 bits" key pair rule.
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key
+}
+
+func TestDER_Magdir(t *testing.T) {
+	m := NewMatcher(loadTestMagicSet(t))
+	key := testRSAKey(t)
+
+	serial, _ := new(big.Int).SetString("010203040506070809", 16)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		// The underscore makes the name a UTF8String, which the rule prints.
+		Subject:   pkix.Name{CommonName: "Test_CA"},
+		NotBefore: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:  time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	want := "Certificate, Version=3, Serial=010203040506070809, Issuer=Test_CA"
+	if got := m.Match(cert); got != want {
+		t.Errorf("X.509 certificate: Match = %q, want %q", got, want)
+	}
+
+	if got, want := m.Match(x509.MarshalPKCS1PrivateKey(key)), "DER Encoded Key Pair, 1024 bits"; got != want {
+		t.Errorf("PKCS#1 key: Match = %q, want %q", got, want)
+	}
+}
+
+func TestDER_PKCS8(t *testing.T) {
+	m := NewMatcher(&MagicSet{Entries: mustParse(t, `
+0	der	seq
+>&0	der	int1=00	PKCS#8 private key
+>&0	der	seq
+>>&0	der	obj_id9=2a864886f70d010101	\b, rsaEncryption
+>>&0	der	null	\b, no parameters
+>&0	der	octet_str
+>>&0	der	seq	\b, RSAPrivateKey
+>>>&0	der	int1=00
+>>>&0	der	int129=x	\b, 1024-bit modulus
+>>>&0	der	int3=x	\b, exponent %s
+`)})
+	key, err := x509.MarshalPKCS8PrivateKey(testRSAKey(t))
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	want := "PKCS#8 private key, rsaEncryption, no parameters, RSAPrivateKey, 1024-bit modulus, exponent 010001"
+	if got := m.Match(key); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+
+	// The outer sequence of a truncated key ends past the input.
+	if got := m.Match(key[:40]); strings.Contains(got, "PKCS#8") {
+		t.Errorf("truncated: Match = %q, want no PKCS#8 match", got)
+	}
+}
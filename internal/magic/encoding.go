@@ -4,16 +4,34 @@ import (
 	"unicode/utf8"
 )
 
-// detectEncoding determines the text encoding of a buffer.
-// Returns a description like "ASCII text" or "" if not text.
-func detectEncoding(buf []byte) string {
+// textEncoding is the character encoding class of a buffer, shared by the
+// prose of detectEncoding and the charset names of detectCharset.
+type textEncoding uint8
+
+const (
+	encBinary textEncoding = iota
+	encEmpty
+	encASCII
+	encUTF8
+	encUTF16LE
+	encUTF16BE
+	encUTF32LE
+	encUTF32BE
+	encISO8859
+	encUnknown8bit // 8-bit text using bytes outside ISO-8859 (0x80-0x9f)
+)
+
+// classifyEncoding determines the encoding class of a buffer. It also
+// reports whether the buffer starts with a UTF-8 BOM and returns the
+// content following that BOM. ASCII content after a UTF-8 BOM is
+// reported as encASCII with hasBOM set.
+func classifyEncoding(buf []byte) (enc textEncoding, hasBOM bool, data []byte) {
 	if len(buf) == 0 {
-		return "empty"
+		return encEmpty, false, buf
 	}
 
 	// Check for UTF-8 BOM
-	hasBOM := false
-	data := buf
+	data = buf
 	if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
 		hasBOM = true
 		data = data[3:]
@@ -22,26 +40,26 @@ func detectEncoding(buf []byte) string {
 	// Check for UTF-16/UTF-32 BOM
 	if len(buf) >= 4 {
 		if buf[0] == 0xFF && buf[1] == 0xFE && buf[2] == 0x00 && buf[3] == 0x00 {
-			return "Unicode text, UTF-32, little-endian"
+			return encUTF32LE, false, buf
 		}
 		if buf[0] == 0x00 && buf[1] == 0x00 && buf[2] == 0xFE && buf[3] == 0xFF {
-			return "Unicode text, UTF-32, big-endian"
+			return encUTF32BE, false, buf
 		}
 	}
 	if len(buf) >= 2 {
 		if buf[0] == 0xFF && buf[1] == 0xFE {
-			return "Unicode text, UTF-16, little-endian text"
+			return encUTF16LE, false, buf
 		}
 		if buf[0] == 0xFE && buf[1] == 0xFF {
-			return "Unicode text, UTF-16, big-endian text"
+			return encUTF16BE, false, buf
 		}
 	}
 
 	// Classify content
 	hasHighBit := false
+	hasC1 := false
 	hasNull := false
 	controlChars := 0
-	lineEndings := detectLineEndings(data)
 
 	for _, b := range data {
 		if b == 0 {
@@ -50,6 +68,9 @@ func detectEncoding(buf []byte) string {
 		}
 		if b > 127 {
 			hasHighBit = true
+			if b < 0xA0 {
+				hasC1 = true
+			}
 		}
 		if b < 32 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1b {
 			controlChars++
@@ -57,38 +78,119 @@ func detectEncoding(buf []byte) string {
 	}
 
 	if hasNull {
-		return "data" // binary
+		return encBinary, hasBOM, data
 	}
 
 	// Too many control chars = binary
 	if controlChars > len(data)/10 && controlChars > 2 {
-		return "data"
+		return encBinary, hasBOM, data
 	}
 
 	if !hasHighBit {
+		return encASCII, hasBOM, data
+	}
+
+	// Check if valid UTF-8
+	if utf8.Valid(data) {
+		return encUTF8, hasBOM, data
+	}
+
+	if hasC1 {
+		return encUnknown8bit, hasBOM, data
+	}
+	return encISO8859, hasBOM, data
+}
+
+// detectEncoding determines the text encoding of a buffer.
+// Returns a description like "ASCII text" or "" if not text.
+func detectEncoding(buf []byte) string {
+	enc, hasBOM, data := classifyEncoding(buf)
+	switch enc {
+	case encEmpty:
+		return "empty"
+	case encBinary:
+		return "data"
+	case encUTF32LE:
+		return "Unicode text, UTF-32, little-endian"
+	case encUTF32BE:
+		return "Unicode text, UTF-32, big-endian"
+	case encUTF16LE:
+		return "Unicode text, UTF-16, little-endian text"
+	case encUTF16BE:
+		return "Unicode text, UTF-16, big-endian text"
+	}
+
+	lineEndings := detectLineEndings(data)
+	switch enc {
+	case encASCII:
 		desc := "ASCII text"
 		if hasBOM {
 			desc = "Unicode text, UTF-8 (with BOM)"
 		}
 		return desc + lineEndings
-	}
-
-	// Check if valid UTF-8
-	if utf8.Valid(data) {
+	case encUTF8:
 		desc := "Unicode text, UTF-8 text"
 		if hasBOM {
 			desc = "Unicode text, UTF-8 (with BOM) text"
 		}
 		return desc + lineEndings
+	default:
+		return "ISO-8859 text" + lineEndings
+	}
+}
+
+// detectCharset determines the charset of a buffer, using the names
+// file(1) prints for --mime-encoding.
+func detectCharset(buf []byte) string {
+	enc, hasBOM, _ := classifyEncoding(buf)
+	switch enc {
+	case encASCII:
+		if hasBOM {
+			return "utf-8"
+		}
+		return "us-ascii"
+	case encUTF8:
+		return "utf-8"
+	case encUTF16LE:
+		return "utf-16le"
+	case encUTF16BE:
+		return "utf-16be"
+	case encUTF32LE:
+		return "utf-32le"
+	case encUTF32BE:
+		return "utf-32be"
+	case encISO8859:
+		return "iso-8859-1"
+	case encUnknown8bit:
+		return "unknown-8bit"
+	default:
+		return "binary"
 	}
+}
 
-	return "ISO-8859 text" + lineEndings
+// encodingWindow returns the leading part of buf, at most max bytes, that is
+// examined to detect its encoding. Like file(1), it drops a UTF-8 sequence
+// cut by the limit rather than let it make valid UTF-8 text look invalid.
+func encodingWindow(buf []byte, max int) []byte {
+	if len(buf) <= max {
+		return buf
+	}
+	w := buf[:max]
+	for i := 1; i < utf8.UTFMax && i <= len(w); i++ {
+		if c := w[len(w)-i]; utf8.RuneStart(c) {
+			if c >= utf8.RuneSelf && !utf8.FullRune(w[len(w)-i:]) {
+				w = w[:len(w)-i]
+			}
+			break
+		}
+	}
+	return w
 }
 
 // isBinaryData returns true if the buffer appears to contain binary data.
 func isBinaryData(buf []byte) bool {
-	enc := detectEncoding(buf)
-	return enc == "data" || enc == ""
+	enc, _, _ := classifyEncoding(buf)
+	return enc == encBinary
 }
 
 func detectLineEndings(data []byte) string {
@@ -0,0 +1,46 @@
+package magic
+
+import "testing"
+
+func TestDetectCharset(t *testing.T) {
+	tests := []struct {
+		buf  []byte
+		want string
+	}{
+		{[]byte("hello world\n"), "us-ascii"},
+		{[]byte("caf\xc3\xa9\n"), "utf-8"},
+		{[]byte("\xef\xbb\xbfhello\n"), "utf-8"},
+		{[]byte("\xff\xfeh\x00i\x00"), "utf-16le"},
+		{[]byte("\xfe\xff\x00h\x00i"), "utf-16be"},
+		{[]byte("\xff\xfe\x00\x00h\x00\x00\x00"), "utf-32le"},
+		{[]byte("caf\xe9\n"), "iso-8859-1"},
+		{[]byte("caf\x85\n"), "unknown-8bit"},
+		{[]byte{0x00, 0x01, 0x02, 0x03}, "binary"},
+		{[]byte{}, "binary"},
+	}
+	for _, tt := range tests {
+		if got := detectCharset(tt.buf); got != tt.want {
+			t.Errorf("detectCharset(%q) = %q, want %q", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		buf  []byte
+		want string
+	}{
+		{[]byte("hello\n"), "ASCII text"},
+		{[]byte("hello\r\n"), "ASCII text, with CRLF line terminators"},
+		{[]byte("caf\xc3\xa9\n"), "Unicode text, UTF-8 text"},
+		{[]byte("\xef\xbb\xbfcaf\xc3\xa9\n"), "Unicode text, UTF-8 (with BOM) text"},
+		{[]byte("caf\xe9\n"), "ISO-8859 text"},
+		{[]byte{0x00, 0x01}, "data"},
+		{[]byte{}, "empty"},
+	}
+	for _, tt := range tests {
+		if got := detectEncoding(tt.buf); got != tt.want {
+			t.Errorf("detectEncoding(%q) = %q, want %q", tt.buf, got, tt.want)
+		}
+	}
+}
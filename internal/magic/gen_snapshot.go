@@ -0,0 +1,28 @@
+//go:build ignore
+
+// gen_snapshot parses the magic files in magicdata/Magdir and writes the
+// snapshot embedded by New to magicdata/magic.snap. Run it with
+// go generate after updating the magic files.
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+
+	"github.com/shirou/gofile/internal/magic"
+)
+
+func main() {
+	set, err := magic.ParseMagicDir("magicdata/Magdir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := set.WriteSnapshot(&buf); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("magicdata/magic.snap", buf.Bytes(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
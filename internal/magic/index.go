@@ -0,0 +1,271 @@
+package magic
+
+import (
+	"maps"
+	"slices"
+)
+
+// groupIndex narrows the groups whose top-level test can match a buffer.
+//
+// Most top-level tests compare a literal string or an exact numeric value at
+// a fixed offset, and can only succeed if the byte at that offset equals the
+// first byte the value occupies in the file. The index records that byte for
+// every such group, so a scan can skip the groups whose key byte is absent.
+//
+// Top-level search tests at a fixed offset are grouped by offset into one
+// multiSearch automaton, so a single pass over the buffer finds the first
+// occurrence of every pattern and rules out the searches that cannot match.
+//
+// The top-level test of every skipped group would have failed, so the
+// strength-ordered scan over the candidates returns the same result as the
+// scan over all groups.
+type groupIndex struct {
+	offsets   []offsetIndex // one per distinct fixed offset, ascending
+	unindexed groupSet      // groups not keyed on a byte, always candidates
+	searches  []searchIndex // one per distinct search offset
+	searchOf  []searchRef   // per group, its search pattern if indexed
+}
+
+// offsetIndex holds the indexed groups whose top-level test reads one offset.
+type offsetIndex struct {
+	offset int
+	start  [257]int32 // groups keyed on byte b are groups[start[b]:start[b+1]]
+	groups []int32
+}
+
+// searchIndex holds the patterns of the top-level searches at one offset.
+type searchIndex struct {
+	offset int
+	ms     *multiSearch
+}
+
+// searchRef locates the pattern of an indexed search group.
+type searchRef struct {
+	search  int32 // index into groupIndex.searches, -1 if not indexed
+	pattern int32 // pattern within the search's multiSearch
+	last    int   // last offset a match may start at, -1 if unbounded
+	len     int   // pattern length
+}
+
+// groupSet is a bitset of group indices. A nil groupSet contains every group.
+type groupSet []uint64
+
+func newGroupSet(n int) groupSet {
+	return make(groupSet, (n+63)/64)
+}
+
+func (g groupSet) add(i int) {
+	g[i/64] |= 1 << (uint(i) % 64)
+}
+
+// has reports whether group i is in g.
+func (g groupSet) has(i int) bool {
+	return g == nil || g[i/64]&(1<<(uint(i)%64)) != 0
+}
+
+// buildGroupIndex indexes the top-level tests of groups.
+func buildGroupIndex(groups []MagicGroup) *groupIndex {
+	type key struct {
+		group int32
+		b     byte
+	}
+	x := &groupIndex{
+		unindexed: newGroupSet(len(groups)),
+		searchOf:  make([]searchRef, len(groups)),
+	}
+	byOffset := make(map[int][]key)
+	searchesByOffset := make(map[int][]int32)
+	for i := range groups {
+		top := groups[i].Entries[0]
+		x.searchOf[i].search = -1
+		b, ok := indexKey(top)
+		if !ok {
+			x.unindexed.add(i)
+			if isIndexableSearch(top) {
+				searchesByOffset[int(top.Offset)] = append(searchesByOffset[int(top.Offset)], int32(i))
+			}
+			continue
+		}
+		byOffset[int(top.Offset)] = append(byOffset[int(top.Offset)], key{int32(i), b})
+	}
+
+	for _, offset := range slices.Sorted(maps.Keys(byOffset)) {
+		keys := byOffset[offset]
+		slices.SortStableFunc(keys, func(a, b key) int { return int(a.b) - int(b.b) })
+		o := offsetIndex{offset: offset, groups: make([]int32, len(keys))}
+		for i, k := range keys {
+			o.groups[i] = k.group
+			o.start[int(k.b)+1] = int32(i + 1)
+		}
+		for b := 1; b < len(o.start); b++ {
+			o.start[b] = max(o.start[b], o.start[b-1])
+		}
+		x.offsets = append(x.offsets, o)
+	}
+
+	for _, offset := range slices.Sorted(maps.Keys(searchesByOffset)) {
+		si := searchIndex{offset: offset}
+		var patterns [][]byte
+		ids := make(map[string]int32) // folded pattern -> pattern index
+		for _, g := range searchesByOffset[offset] {
+			top := groups[g].Entries[0]
+			folded := string(foldASCII(top.Value.Str))
+			id, ok := ids[folded]
+			if !ok {
+				id = int32(len(patterns))
+				ids[folded] = id
+				patterns = append(patterns, top.Value.Str)
+			}
+			ref := searchRef{search: int32(len(x.searches)), pattern: id, last: -1, len: len(top.Value.Str)}
+			if top.StrRange > 0 {
+				ref.last = offset + int(top.StrRange)
+			}
+			x.searchOf[g] = ref
+		}
+		si.ms = newMultiSearch(patterns)
+		x.searches = append(x.searches, si)
+	}
+	return x
+}
+
+// indexKey returns the byte that must be at entry's offset for the entry to
+// match, and whether the entry can be indexed on it. Only exact comparisons
+// at a fixed offset qualify: plain strings, and unmasked numeric types whose
+// byte order is known.
+func indexKey(entry *MagicEntry) (byte, bool) {
+	if entry.Relation != '=' || !hasFixedOffset(entry) {
+		return 0, false
+	}
+	if entry.Type == TypeString {
+		const inexact = StrFlagCompactWS | StrFlagOptionalWS | StrFlagIgnoreLower | StrFlagIgnoreUpper | StrFlagTrim
+		if entry.StrFlags&inexact != 0 || len(entry.Value.Str) == 0 {
+			return 0, false
+		}
+		return entry.Value.Str[0], true
+	}
+	if entry.HasMask || entry.Value.IsString {
+		return 0, false
+	}
+	v := entry.Value.Numeric
+	switch entry.Type {
+	case TypeByte, TypeShort, TypeLEShort, TypeLong, TypeLELong, TypeQuad, TypeLEQuad:
+		return byte(v), true
+	case TypeBEShort:
+		return byte(v >> 8), true
+	case TypeBELong:
+		return byte(v >> 24), true
+	case TypeBEQuad:
+		return byte(v >> 56), true
+	}
+	return 0, false
+}
+
+// isIndexableSearch reports whether entry is a search at a fixed offset
+// that matches only where its pattern occurs, ignoring ASCII case. Searches
+// with whitespace flags match other byte sequences and are not indexed.
+func isIndexableSearch(entry *MagicEntry) bool {
+	return entry.Type == TypeSearch && entry.Relation == '=' && hasFixedOffset(entry) &&
+		entry.StrFlags&(StrFlagCompactWS|StrFlagOptionalWS) == 0 && len(entry.Value.Str) > 0
+}
+
+func hasFixedOffset(entry *MagicEntry) bool {
+	return entry.Offset >= 0 && entry.Flag&(FlagIndir|FlagOffAdd|FlagNegative) == 0
+}
+
+// groupFilter reports, for one buffer, whether the top-level test of a group
+// may match. The byte index is applied up front; search automata run lazily
+// and only as far as the searches reached so far need, so an early strong
+// match does not pay for scanning the buffer. A groupFilter can be reset
+// and reused for another buffer.
+type groupFilter struct {
+	index      *groupIndex
+	buf        []byte
+	whole      bool        // buf is the whole input
+	canceled   func() bool // polled while scanning
+	candidates groupSet
+	scans      []searchScan // per search
+	started    []bool       // whether scans[i] has been started for buf
+}
+
+// filter returns the groupFilter for buf, the leading part of an input of
+// inputLen bytes. A nil index yields a filter that accepts every group.
+func (x *groupIndex) filter(buf []byte, inputLen int, canceled func() bool) *groupFilter {
+	f := new(groupFilter)
+	f.reset(x, buf, inputLen, canceled)
+	return f
+}
+
+// reset prepares f for buf, the leading part of an input of inputLen bytes,
+// reusing its storage. Offsets past the end of buf may still be readable
+// through random access, so the groups testing them are always candidates.
+func (f *groupFilter) reset(x *groupIndex, buf []byte, inputLen int, canceled func() bool) {
+	f.index, f.buf, f.whole, f.canceled = x, buf, inputLen <= len(buf), canceled
+	if x == nil {
+		f.candidates = nil
+		return
+	}
+	f.candidates = append(f.candidates[:0], x.unindexed...)
+	for i := range x.offsets {
+		o := &x.offsets[i]
+		groups := o.groups
+		if o.offset < len(buf) {
+			b := buf[o.offset]
+			groups = o.groups[o.start[b]:o.start[int(b)+1]]
+		}
+		for _, g := range groups {
+			f.candidates.add(int(g))
+		}
+	}
+	if len(f.scans) < len(x.searches) {
+		f.scans = make([]searchScan, len(x.searches))
+		f.started = make([]bool, len(x.searches))
+	}
+	clear(f.started)
+}
+
+// may reports whether the top-level test of group i may match.
+func (f *groupFilter) may(i int) bool {
+	if f.index == nil {
+		return true
+	}
+	if !f.candidates.has(i) {
+		return false
+	}
+	ref := f.index.searchOf[i]
+	if ref.search < 0 {
+		return true
+	}
+	if !f.whole && (ref.last < 0 || ref.last+ref.len > len(f.buf)) {
+		return true // the search may read past buf
+	}
+
+	si := &f.index.searches[ref.search]
+	if si.offset >= len(f.buf) {
+		return false
+	}
+	sc := &f.scans[ref.search]
+	if !f.started[ref.search] {
+		si.ms.startScan(sc)
+		f.started[ref.search] = true
+	}
+	// A match must end by the last start position plus the pattern length.
+	data := f.buf[si.offset:]
+	end := len(data)
+	if ref.last >= 0 {
+		end = min(end, ref.last-si.offset+ref.len)
+	}
+	if sc.first[ref.pattern] < 0 && !si.ms.advance(sc, data, end, f.canceled) {
+		return true // canceled; the caller stops at its next check
+	}
+	start := sc.first[ref.pattern]
+	return start >= 0 && (ref.last < 0 || si.offset+start <= ref.last)
+}
+
+// foldASCII returns b with ASCII letters lowered.
+func foldASCII(b []byte) []byte {
+	folded := make([]byte, len(b))
+	for i, c := range b {
+		folded[i] = toLowerASCII(c)
+	}
+	return folded
+}
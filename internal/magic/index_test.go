@@ -0,0 +1,199 @@
+package magic
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indexSamples returns buffers that satisfy the top-level tests of the
+// indexed groups of set, so that many groups become candidates, followed by
+// the files of the upstream test corpus if it is present.
+// Search patterns are embedded in text, the other values in zeros.
+func indexSamples(tb testing.TB, set *MagicSet) [][]byte {
+	tb.Helper()
+	var samples [][]byte
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 100))
+	for _, g := range set.Groups {
+		top := g.Entries[0]
+		if top.Offset > 64*1024 {
+			continue
+		}
+		if isIndexableSearch(top) {
+			// Embed the pattern in text, within the search range.
+			pos := int(top.Offset) + min(int(top.StrRange)/2, 100)
+			buf := append([]byte{}, text...)
+			buf = append(buf[:pos:pos], append(top.Value.Str, buf[pos:]...)...)
+			samples = append(samples, buf)
+			continue
+		}
+		if _, ok := indexKey(top); !ok {
+			continue
+		}
+		var value []byte
+		v := top.Value.Numeric
+		switch top.Type {
+		case TypeString:
+			value = top.Value.Str
+		case TypeByte:
+			value = []byte{byte(v)}
+		case TypeShort, TypeLEShort:
+			value = binary.LittleEndian.AppendUint16(nil, uint16(v))
+		case TypeBEShort:
+			value = binary.BigEndian.AppendUint16(nil, uint16(v))
+		case TypeLong, TypeLELong:
+			value = binary.LittleEndian.AppendUint32(nil, uint32(v))
+		case TypeBELong:
+			value = binary.BigEndian.AppendUint32(nil, uint32(v))
+		case TypeQuad, TypeLEQuad:
+			value = binary.LittleEndian.AppendUint64(nil, v)
+		case TypeBEQuad:
+			value = binary.BigEndian.AppendUint64(nil, v)
+		}
+		buf := make([]byte, max(4096, int(top.Offset)+len(value)))
+		copy(buf[top.Offset:], value)
+		samples = append(samples, buf)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(testDir, "*.testfile"))
+	for _, name := range files {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		samples = append(samples, buf)
+	}
+	return samples
+}
+
+// linearScan returns a copy of set without the prefilter index.
+func linearScan(set *MagicSet) *MagicSet {
+	linear := *set
+	linear.index = nil
+	return &linear
+}
+
+func TestGroupIndex_MatchesLinearScan(t *testing.T) {
+	if testing.Short() {
+		t.Skip("matches the full magic database against thousands of samples")
+	}
+	set := loadTestMagicSet(t)
+	if set.index == nil || len(set.index.offsets) == 0 {
+		t.Fatal("buildGroups did not index any groups")
+	}
+	indexed, linear := NewMatcher(set), NewMatcher(linearScan(set))
+
+	samples := indexSamples(t, set)
+	samples = append(samples,
+		nil,
+		[]byte("#!/bin/sh\necho hello\n"),
+		[]byte(strings.Repeat("plain text\n", 100)),
+		[]byte("<?xml version=\"1.0\"?>\n<svg></svg>\n"),
+	)
+	for i, buf := range samples {
+		got, want := indexed.MatchResult(buf), linear.MatchResult(buf)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sample %d: indexed MatchResult = %+v, linear = %+v", i, got, want)
+		}
+		if i%16 == 0 {
+			if got, want := indexed.MatchAll(buf), linear.MatchAll(buf); got != want {
+				t.Errorf("sample %d: indexed MatchAll = %q, linear = %q", i, got, want)
+			}
+		}
+	}
+}
+
+func TestGroupIndex_Filter(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, `
+0	string	%PDF-	PDF document
+0	belong	0x89504e47	PNG image
+4	leshort	0x1234	short at 4
+8	string/c	abc	case-insensitive string
+0	lelong&0xff	0x12	masked
+0	search/10	needle	search
+0	search/100/c	hello	case-insensitive search
+2	search/10/w	a\ b	whitespace search
+`)}
+	set.buildGroups()
+
+	always := []string{"case-insensitive string", "masked", "whitespace search"}
+	tests := []struct {
+		name  string
+		buf   []byte
+		input int      // input length; the buffer length if zero
+		want  []string // descriptions of the groups that may match
+	}{
+		{"pdf", []byte("%PDF-1.4 more data"), 0, []string{"PDF document"}},
+		{"png", []byte("\x89PNG\x34\x12"), 0, []string{"PNG image", "short at 4"}},
+		{"short", []byte("x"), 0, []string{"short at 4"}},
+		{"search", []byte("...needle, Hello"), 0, []string{"search", "case-insensitive search"}},
+		{"search out of range", []byte("...........needle"), 0, nil},
+		{"search past buffer", []byte("........"), 1 << 20, []string{"search", "case-insensitive search"}},
+	}
+	for _, tt := range tests {
+		input := tt.input
+		if input == 0 {
+			input = len(tt.buf)
+		}
+		filter := set.index.filter(tt.buf, input, nil)
+		var got []string
+		for i, g := range set.Groups {
+			if filter.may(i) {
+				got = append(got, g.Entries[0].Desc)
+			}
+		}
+		if want := append(tt.want, always...); !sameStrings(got, want) {
+			t.Errorf("%s: groups = %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func mustParse(t *testing.T, rules string) []*MagicEntry {
+	t.Helper()
+	entries, err := ParseMagicBytes("test", []byte(rules))
+	if err != nil {
+		t.Fatalf("ParseMagicBytes: %v", err)
+	}
+	return entries
+}
+
+func sameStrings(a, b []string) bool {
+	seen := make(map[string]int)
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkMatchResult(b *testing.B) {
+	set, err := ParseMagicDir(magicDir)
+	if err != nil {
+		b.Fatalf("ParseMagicDir: %v", err)
+	}
+	samples := indexSamples(b, set)
+	for _, bm := range []struct {
+		name string
+		set  *MagicSet
+	}{
+		{"indexed", set},
+		{"linear", linearScan(set)},
+	} {
+		m := NewMatcher(bm.set)
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.MatchResult(samples[i%len(samples)])
+			}
+		})
+	}
+}
@@ -71,14 +71,15 @@ func TestIntegration(t *testing.T) {
 
 			m := NewMatcher(testSet)
 			// 'x' flag: simulate executable file mode for ${x?...} expansion
+			var mode os.FileMode
 			if strings.Contains(flags, "x") {
-				m.fileMode = 0755
+				mode = 0755
 			}
 			var result string
 			if strings.Contains(flags, "k") {
-				result = m.MatchAll(buf)
+				result = m.MatchAllWithMode(buf, mode)
 			} else {
-				result = m.Match(buf)
+				result = m.MatchWithMode(buf, mode)
 			}
 
 			if result != expected {
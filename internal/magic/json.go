@@ -4,32 +4,51 @@ import (
 	"bytes"
 )
 
+// Descriptions produced by detectJSON.
+const (
+	jsonDesc   = "JSON text data"
+	ndjsonDesc = "New Line Delimited JSON text data"
+)
+
 // detectJSON checks if the buffer contains JSON text data.
 // Returns "JSON text data" or "" if not JSON.
 func detectJSON(buf []byte) string {
-	// Trim leading whitespace and BOM
-	data := bytes.TrimLeft(buf, " \t\n\r")
-	if len(data) > 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
-		data = data[3:]
-		data = bytes.TrimLeft(data, " \t\n\r")
-	}
-
+	data := jsonStart(buf)
 	if len(data) == 0 {
 		return ""
 	}
 
 	// Check for NDJSON first (multiple JSON objects per line)
 	if data[0] == '{' && isNDJSON(data) {
-		return "New Line Delimited JSON text data"
+		return ndjsonDesc
 	}
 
 	if (data[0] == '{' || data[0] == '[') && looksLikeJSON(data) {
-		return "JSON text data"
+		return jsonDesc
 	}
 
 	return ""
 }
 
+// jsonStart returns buf past leading whitespace and a BOM. JSON is found
+// only where it starts with '{' or '['.
+func jsonStart(buf []byte) []byte {
+	data := bytes.TrimLeft(buf, " \t\n\r")
+	if len(data) > 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
+		data = data[3:]
+		data = bytes.TrimLeft(data, " \t\n\r")
+	}
+	return data
+}
+
+// jsonMimeType returns the MIME type for a detectJSON description.
+func jsonMimeType(desc string) string {
+	if desc == ndjsonDesc {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
 // isNDJSON checks if data looks like Newline Delimited JSON.
 func isNDJSON(data []byte) bool {
 	lines := bytes.Split(bytes.TrimRight(data, "\n\r"), []byte("\n"))
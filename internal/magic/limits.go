@@ -0,0 +1,122 @@
+package magic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Default evaluation limits, those of file(1).
+const (
+	DefaultIndirMax    = 50              // nested indirect rules
+	DefaultNameMax     = 50              // nested use of named rules
+	DefaultElfNotesMax = 256             // ELF notes examined
+	DefaultElfPhnumMax = 2048            // ELF program headers
+	DefaultElfShnumMax = 32768           // ELF section headers
+	DefaultEncodingMax = 64 * 1024       // bytes examined to detect the text encoding
+	DefaultRegexMax    = 8192            // bytes a regex rule searches
+	DefaultBytesMax    = 7 * 1024 * 1024 // bytes of a file read at once
+)
+
+// limits holds the evaluation limits of a Matcher, with defaults applied.
+type limits struct {
+	indir    int
+	name     int
+	elfNotes int
+	elfPhnum int
+	elfShnum int
+	encoding int
+	regex    int
+	bytes    int
+}
+
+var defaultLimits = limits{
+	indir:    DefaultIndirMax,
+	name:     DefaultNameMax,
+	elfNotes: DefaultElfNotesMax,
+	elfPhnum: DefaultElfPhnumMax,
+	elfShnum: DefaultElfShnumMax,
+	encoding: DefaultEncodingMax,
+	regex:    DefaultRegexMax,
+	bytes:    DefaultBytesMax,
+}
+
+// textPrefix returns the number of leading bytes of an input read before
+// matching when the rest is read as rules need it: those examined to detect
+// the text encoding, within the bytes and in-memory prefix limits.
+func (l limits) textPrefix() int {
+	return min(l.encoding, l.bytes, prefixMax)
+}
+
+// limits returns the evaluation limits selected by o.
+func (o Options) limits() limits {
+	orDefault := func(v, def int) int {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+	return limits{
+		indir:    orDefault(o.IndirMax, DefaultIndirMax),
+		name:     orDefault(o.NameMax, DefaultNameMax),
+		elfNotes: orDefault(o.ElfNotesMax, DefaultElfNotesMax),
+		elfPhnum: orDefault(o.ElfPhnumMax, DefaultElfPhnumMax),
+		elfShnum: orDefault(o.ElfShnumMax, DefaultElfShnumMax),
+		encoding: orDefault(o.EncodingMax, DefaultEncodingMax),
+		regex:    orDefault(o.RegexMax, DefaultRegexMax),
+		bytes:    orDefault(o.BytesMax, DefaultBytesMax),
+	}
+}
+
+// params maps file(1)'s -P parameter names to the Options fields they set.
+var params = []struct {
+	name  string
+	field func(*Options) *int
+}{
+	{"indir", func(o *Options) *int { return &o.IndirMax }},
+	{"name", func(o *Options) *int { return &o.NameMax }},
+	{"elf_notes", func(o *Options) *int { return &o.ElfNotesMax }},
+	{"elf_phnum", func(o *Options) *int { return &o.ElfPhnumMax }},
+	{"elf_shnum", func(o *Options) *int { return &o.ElfShnumMax }},
+	{"encoding", func(o *Options) *int { return &o.EncodingMax }},
+	{"regex", func(o *Options) *int { return &o.RegexMax }},
+	{"bytes", func(o *Options) *int { return &o.BytesMax }},
+}
+
+// ParamNames returns the names SetParam accepts, in file(1)'s order.
+func ParamNames() []string {
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = p.name
+	}
+	return names
+}
+
+// SetParam sets the limit that file(1) calls name, as with file -P
+// name=value.
+func (o *Options) SetParam(name string, value int) error {
+	for _, p := range params {
+		if p.name == name {
+			if value <= 0 {
+				return fmt.Errorf("invalid value %d for param %s", value, name)
+			}
+			*p.field(o) = value
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown param %s (want one of %s)", name, strings.Join(ParamNames(), ", "))
+}
+
+// LimitError reports that identifying an input exceeded an evaluation
+// limit. file(1) reports these as errors rather than as a type. Only the
+// indir and name limits fail; the others bound how much is examined.
+type LimitError struct {
+	Param string // the -P parameter name of the limit: indir or name
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	if e.Param == "indir" {
+		return fmt.Sprintf("indirect count (%d) exceeded", e.Limit)
+	}
+	return fmt.Sprintf("name use count (%d) exceeded", e.Limit)
+}
@@ -0,0 +1,159 @@
+package magic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   int
+		wantErr bool
+		get     func(Options) int
+	}{
+		{"indir", 3, false, func(o Options) int { return o.IndirMax }},
+		{"name", 4, false, func(o Options) int { return o.NameMax }},
+		{"elf_notes", 5, false, func(o Options) int { return o.ElfNotesMax }},
+		{"elf_phnum", 6, false, func(o Options) int { return o.ElfPhnumMax }},
+		{"elf_shnum", 7, false, func(o Options) int { return o.ElfShnumMax }},
+		{"encoding", 8, false, func(o Options) int { return o.EncodingMax }},
+		{"regex", 9, false, func(o Options) int { return o.RegexMax }},
+		{"bytes", 10, false, func(o Options) int { return o.BytesMax }},
+		{"indir", 0, true, nil},
+		{"bytes", -1, true, nil},
+		{"nosuch", 1, true, nil},
+	}
+	for _, tt := range tests {
+		var opts Options
+		err := opts.SetParam(tt.name, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetParam(%q, %d) error = %v, wantErr %v", tt.name, tt.value, err, tt.wantErr)
+			continue
+		}
+		if tt.get != nil && tt.get(opts) != tt.value {
+			t.Errorf("SetParam(%q, %d) set %d", tt.name, tt.value, tt.get(opts))
+		}
+	}
+}
+
+func TestOptionsLimits_Defaults(t *testing.T) {
+	if got := (Options{}).limits(); got != defaultLimits {
+		t.Errorf("Options{}.limits() = %+v, want %+v", got, defaultLimits)
+	}
+	got := Options{IndirMax: 3, BytesMax: -1}.limits()
+	if got.indir != 3 || got.bytes != DefaultBytesMax {
+		t.Errorf("limits() = %+v, want indir 3 and default bytes", got)
+	}
+}
+
+func TestLimit_Indirect(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, "0\tstring\tLOOP\tloop\n>0\tindirect\tx\n")}
+	lim := defaultLimits
+	lim.indir = 3
+	m := newMatcher(set, lim)
+
+	const want = "ERROR: indirect count (3) exceeded"
+	if got := m.MatchResult([]byte("LOOP")).Desc; got != want {
+		t.Errorf("MatchResult = %q, want %q", got, want)
+	}
+	_, err := m.MatchResultContext(context.Background(), []byte("LOOP"), 0)
+	var le *LimitError
+	if !errors.As(err, &le) || le.Param != "indir" || le.Limit != 3 {
+		t.Errorf("MatchResultContext error = %v, want indir LimitError", err)
+	}
+}
+
+func TestLimit_Name(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, `
+0	name	again
+>0	use	again
+0	string	LOOP	loop
+>0	use	again
+`)}
+	lim := defaultLimits
+	lim.name = 5
+	m := newMatcher(set, lim)
+
+	const want = "ERROR: name use count (5) exceeded"
+	if got := m.MatchResult([]byte("LOOP")).Desc; got != want {
+		t.Errorf("MatchResult = %q, want %q", got, want)
+	}
+}
+
+func TestLimit_Regex(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, "0\tregex\tneedle\tfound\n")}
+	buf := []byte(strings.Repeat("a", 100) + "needle")
+
+	if got := newMatcher(set, defaultLimits).MatchResult(buf).Desc; !strings.HasPrefix(got, "found") {
+		t.Errorf("default limits: MatchResult = %q, want prefix %q", got, "found")
+	}
+	lim := defaultLimits
+	lim.regex = 50
+	if got := newMatcher(set, lim).MatchResult(buf).Desc; strings.HasPrefix(got, "found") {
+		t.Errorf("regex limit 50: MatchResult = %q, want no regex match", got)
+	}
+}
+
+func TestLimit_Encoding(t *testing.T) {
+	set := &MagicSet{}
+	buf := []byte(strings.Repeat("a", 100) + "caf\xc3\xa9\n")
+
+	if got := newMatcher(set, defaultLimits).MatchResult(buf).Desc; got != "Unicode text, UTF-8 text" {
+		t.Errorf("default limits: MatchResult = %q, want %q", got, "Unicode text, UTF-8 text")
+	}
+	lim := defaultLimits
+	lim.encoding = 50
+	if got := newMatcher(set, lim).MatchResult(buf).Desc; got != "ASCII text, with no line terminators" {
+		t.Errorf("encoding limit 50: MatchResult = %q, want %q", got, "ASCII text, with no line terminators")
+	}
+}
+
+func TestEncodingWindow(t *testing.T) {
+	tests := []struct {
+		buf  string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"ab\xc3\xa9cd", 3, "ab"},
+		{"ab\xc3\xa9cd", 4, "ab\xc3\xa9"},
+		{"ab\xe2\x82\xac", 4, "ab"},
+		{"ab\xff\xfe", 3, "ab\xff"},
+	}
+	for _, tt := range tests {
+		if got := encodingWindow([]byte(tt.buf), tt.max); string(got) != tt.want {
+			t.Errorf("encodingWindow(%q, %d) = %q, want %q", tt.buf, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestLimit_Bytes(t *testing.T) {
+	fi := newFileIdentifier(&MagicSet{}, Options{BytesMax: 64})
+	r := bytes.NewReader(bytes.Repeat([]byte("text\n"), 100))
+	if _, err := fi.IdentifyReader(r); err != nil {
+		t.Fatalf("IdentifyReader: %v", err)
+	}
+	if consumed := r.Size() - int64(r.Len()); consumed != 64 {
+		t.Errorf("IdentifyReader consumed %d bytes, want 64", consumed)
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	tests := []struct {
+		err  *LimitError
+		want string
+	}{
+		{&LimitError{Param: "indir", Limit: 50}, "indirect count (50) exceeded"},
+		{&LimitError{Param: "name", Limit: 50}, "name use count (50) exceeded"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
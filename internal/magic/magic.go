@@ -1,38 +1,95 @@
 package magic
 
 import (
-	"embed"
+	"context"
+	_ "embed"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 )
 
-//go:embed all:magicdata
-var embeddedMagicFS embed.FS
+//go:generate go run gen_snapshot.go
+
+// embeddedSnapshot is the magic database in magicdata/Magdir, parsed ahead
+// of time by gen_snapshot.go so that New does not parse it at startup.
+//
+//go:embed magicdata/magic.snap
+var embeddedSnapshot []byte
+
+// readBufPool holds read buffers shared by all identification calls.
+// Results never reference buffer memory, so a buffer can be returned as soon
+// as matching is done.
+var readBufPool = sync.Pool{
+	New: func() any { return new([]byte) },
+}
+
+// prefixMax is the largest number of leading bytes of a file read into
+// memory before matching, as file(1) read before bytes_max. Rules that look
+// further read the rest through random access.
+const prefixMax = 1 << 20
+
+// getReadBuf returns a pooled buffer of n bytes. Return it with
+// readBufPool.Put.
+func getReadBuf(n int) *[]byte {
+	bp := readBufPool.Get().(*[]byte)
+	if cap(*bp) < n {
+		*bp = make([]byte, n)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
 
 // Options controls the behavior of file identification.
 type Options struct {
-	MimeType bool
-	Brief    bool
+	MimeType     bool // output the MIME type instead of the description (file --mime-type)
+	MimeEncoding bool // output the charset; with MimeType, "type; charset=..." (file -i)
+	Extension    bool // output the "/"-separated extensions, "???" if unknown (file --extension)
+	Apple        bool // output the Apple creator/type code, "UNKNUNKN" if unknown (file --apple)
+	Mmap         bool // memory-map regular files instead of reading them (Linux only; falls back to read)
+	Brief        bool
+
+	// Evaluation limits, named after file(1)'s -P parameters (see SetParam).
+	// Zero selects file(1)'s default.
+	IndirMax    int // nested indirect rules (indir)
+	NameMax     int // nested use of named rules (name)
+	ElfNotesMax int // ELF notes examined (elf_notes)
+	ElfPhnumMax int // ELF program headers (elf_phnum)
+	ElfShnumMax int // ELF section headers (elf_shnum)
+	EncodingMax int // bytes examined to detect the text encoding (encoding)
+	RegexMax    int // bytes a regex rule searches (regex)
+	BytesMax    int // bytes of a file read at once, and of a stream (bytes)
 }
 
 // FileIdentifier is the main entry point for file identification.
+// It is safe for concurrent use by multiple goroutines.
 type FileIdentifier struct {
 	set     *MagicSet
 	matcher *Matcher
 	options Options
 }
 
+// newFileIdentifier returns a FileIdentifier matching the rules of set
+// within the limits selected by opts.
+func newFileIdentifier(set *MagicSet, opts Options) *FileIdentifier {
+	return &FileIdentifier{
+		set:     set,
+		matcher: newMatcher(set, opts.limits()),
+		options: opts,
+	}
+}
+
 // New creates a FileIdentifier loading magic from the embedded database.
 func New(opts Options) (*FileIdentifier, error) {
-	magicFS, err := fs.Sub(embeddedMagicFS, "magicdata/Magdir")
+	set, err := decodeSnapshot(embeddedSnapshot)
 	if err != nil {
 		return nil, fmt.Errorf("embedded magic data: %w", err)
 	}
-	return NewFromFS(magicFS, opts)
+	return newFileIdentifier(set, opts), nil
 }
 
 // NewFromFS creates a FileIdentifier loading magic from a filesystem.
@@ -52,20 +109,12 @@ func NewFromFS(magicFS fs.FS, opts Options) (*FileIdentifier, error) {
 		if err != nil {
 			continue
 		}
-		parsed, err := ParseMagicBytes(de.Name(), data)
-		if err != nil {
-			continue
-		}
-		set.Entries = append(set.Entries, parsed...)
+		set.addMagic(de.Name(), data)
 	}
 
 	set.buildGroups()
 
-	return &FileIdentifier{
-		set:     set,
-		matcher: NewMatcher(set),
-		options: opts,
-	}, nil
+	return newFileIdentifier(set, opts), nil
 }
 
 // NewFromDir creates a FileIdentifier loading magic from a directory path.
@@ -74,14 +123,10 @@ func NewFromDir(dir string, opts Options) (*FileIdentifier, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &FileIdentifier{
-		set:     set,
-		matcher: NewMatcher(set),
-		options: opts,
-	}, nil
+	return newFileIdentifier(set, opts), nil
 }
 
-// NewFromPath creates a FileIdentifier from a path that can be either
+// NewFromPath creates a FileIdentifier from a path that can be a snapshot,
 // a .mgc compiled file or a directory of text magic files.
 func NewFromPath(path string, opts Options) (*FileIdentifier, error) {
 	info, err := os.Stat(path)
@@ -91,6 +136,9 @@ func NewFromPath(path string, opts Options) (*FileIdentifier, error) {
 	if info.IsDir() {
 		return NewFromDir(path, opts)
 	}
+	if isSnapshotFile(path) {
+		return NewFromSnapshot(path, opts)
+	}
 	if strings.HasSuffix(path, ".mgc") || !info.IsDir() {
 		// Try as .mgc first
 		fi, err := NewFromMgcFile(path, opts)
@@ -150,10 +198,34 @@ func NewFromSystemMgc(localDir string, opts Options) (*FileIdentifier, error) {
 
 // IdentifyFile identifies a file by path.
 func (fi *FileIdentifier) IdentifyFile(path string) (string, error) {
+	result, err := fi.IdentifyFileResult(path)
+	if err != nil {
+		return "", err
+	}
+	return fi.Format(result), nil
+}
+
+// IdentifyFileResult identifies a file by path and returns the structured result.
+func (fi *FileIdentifier) IdentifyFileResult(path string) (Result, error) {
+	return fi.identifyFile(context.Background(), path)
+}
+
+// IdentifyFileContext is like IdentifyFile but returns ctx.Err() as soon as
+// possible once ctx is canceled or its deadline passes.
+func (fi *FileIdentifier) IdentifyFileContext(ctx context.Context, path string) (string, error) {
+	result, err := fi.identifyFile(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return fi.Format(result), nil
+}
+
+// identifyFile identifies a file by path, stopping early if ctx is canceled.
+func (fi *FileIdentifier) identifyFile(ctx context.Context, path string) (Result, error) {
 	// Check filesystem magic first
 	info, err := os.Lstat(path)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
 
 	if !info.Mode().IsRegular() {
@@ -161,25 +233,101 @@ func (fi *FileIdentifier) IdentifyFile(path string) (string, error) {
 	}
 
 	if info.Size() == 0 {
-		return "empty", nil
+		return emptyFileResult(), nil
 	}
 
-	// Read file content
-	maxBytes := 1024 * 1024 // 1MB max
 	f, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
 	defer func() { _ = f.Close() }()
 
-	buf := make([]byte, maxBytes)
-	n, _ := f.Read(buf)
-	buf = buf[:n]
+	if fi.options.Mmap {
+		if result, mapped, err := fi.identifyMapped(ctx, f, info.Size(), info.Mode()); mapped {
+			return result, err
+		}
+	}
+	return fi.identifyReaderAt(ctx, f, info.Size(), info.Mode())
+}
+
+// IdentifyReader identifies content read from r, consuming only the bytes
+// the rules read: those examined to detect the text encoding, then as far
+// as rules look. Tests at offsets from the end read r to its end. At most
+// Options.BytesMax bytes are consumed; as in file(1), offsets from the end
+// of a longer stream are measured from there.
+func (fi *FileIdentifier) IdentifyReader(r io.Reader) (string, error) {
+	result, err := fi.IdentifyReaderResult(r)
+	if err != nil {
+		return "", err
+	}
+	return fi.Format(result), nil
+}
+
+// IdentifyReaderResult is like IdentifyReader but returns the structured result.
+func (fi *FileIdentifier) IdentifyReaderResult(r io.Reader) (Result, error) {
+	return fi.identifyStream(context.Background(), r, 0)
+}
 
+// IdentifyReaderAt identifies the size bytes of content available from r.
+// Random access lets ELF analysis and rules with large or indirect offsets
+// behave as they do for files on disk.
+func (fi *FileIdentifier) IdentifyReaderAt(r io.ReaderAt, size int64) (string, error) {
+	result, err := fi.IdentifyReaderAtResult(r, size)
+	if err != nil {
+		return "", err
+	}
+	return fi.Format(result), nil
+}
+
+// IdentifyReaderAtResult is like IdentifyReaderAt but returns the structured result.
+func (fi *FileIdentifier) IdentifyReaderAtResult(r io.ReaderAt, size int64) (Result, error) {
+	if size < 0 {
+		return Result{}, fmt.Errorf("invalid size %d", size)
+	}
+	return fi.identifyReaderAt(context.Background(), r, size, 0)
+}
+
+// identifyReaderAt reads the leading window of r and identifies it. mode
+// is the file mode used for ${x?...} expansion.
+func (fi *FileIdentifier) identifyReaderAt(ctx context.Context, r io.ReaderAt, size int64, mode os.FileMode) (Result, error) {
+	bp := getReadBuf(int(min(size, prefixMax, int64(fi.matcher.limits.bytes))))
+	defer readBufPool.Put(bp)
+	buf := *bp
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return Result{}, err
+	}
+	return fi.identifyContent(ctx, buf[:n], randomAccess{r: r, size: size}, mode)
+}
+
+// identifyStream identifies the content read from r, reading it only as
+// far as the rules need. mode is the file mode used for ${x?...} expansion.
+func (fi *FileIdentifier) identifyStream(ctx context.Context, r io.Reader, mode os.FileMode) (Result, error) {
+	st := newStreamInput(r, fi.matcher.limits.bytes)
+	defer st.release()
+	buf := st.prefix(fi.matcher.limits.textPrefix())
+	if st.err != nil && st.err != io.EOF {
+		return Result{}, st.err
+	}
+	ra := randomAccess{r: st, stream: st, size: int64(st.limit)}
+	if st.ended() {
+		ra = randomAccess{} // buf is the whole input
+	}
+	result, err := fi.identifyContent(ctx, buf, ra, mode)
+	if st.err != nil && st.err != io.EOF {
+		return Result{}, st.err
+	}
+	return result, err
+}
+
+// identifyContent identifies buf, the leading bytes of a file. If ra.r is
+// non-nil, it provides access to the whole file for ELF analysis and for
+// rules that read past buf.
+func (fi *FileIdentifier) identifyContent(ctx context.Context, buf []byte, ra randomAccess, mode os.FileMode) (Result, error) {
 	// Run ELF analysis for additional info (dynamically linked, interpreter, etc.)
-	elfResult := tryELF(buf, f, info.Size())
+	elfResult := tryELF(buf, ra.r, ra.size, fi.matcher.limits)
 
-	fileMode := info.Mode()
+	fileMode := mode
 	if elfResult != nil && elfResult.isPIE {
 		// DF_1_PIE sets execute bits for ${x?pie executable:shared object} expansion
 		fileMode |= 0111
@@ -188,12 +336,16 @@ func (fi *FileIdentifier) IdentifyFile(path string) (string, error) {
 		fileMode &^= 0111
 	}
 
-	result := fi.matcher.MatchWithMode(buf, fileMode)
+	result, err := fi.matcher.matchInput(ctx, buf, ra, fileMode)
+	if err != nil {
+		return Result{}, err
+	}
 
 	// Append ELF details after magic match
 	if elfResult != nil {
 		if extra := formatELFInfo(elfResult); extra != "" {
-			result += ", " + extra
+			result.Desc += ", " + extra
+			result.Source = SourceELF
 		}
 	}
 
@@ -202,12 +354,83 @@ func (fi *FileIdentifier) IdentifyFile(path string) (string, error) {
 
 // IdentifyBuffer identifies content from a byte buffer.
 func (fi *FileIdentifier) IdentifyBuffer(buf []byte) string {
-	return fi.matcher.Match(buf)
+	return fi.Format(fi.matcher.MatchResult(buf))
+}
+
+// IdentifyBufferResult identifies content from a byte buffer and returns the
+// structured result.
+func (fi *FileIdentifier) IdentifyBufferResult(buf []byte) Result {
+	return fi.matcher.MatchResult(buf)
+}
+
+// IdentifyBufferContext is like IdentifyBuffer but returns ctx.Err() as soon
+// as possible once ctx is canceled or its deadline passes.
+func (fi *FileIdentifier) IdentifyBufferContext(ctx context.Context, buf []byte) (string, error) {
+	result, err := fi.matcher.MatchResultContext(ctx, buf, 0)
+	if err != nil {
+		return "", err
+	}
+	return fi.Format(result), nil
+}
+
+// Format renders a Result the way file(1) prints it for the configured options.
+func (fi *FileIdentifier) Format(r Result) string {
+	switch {
+	case fi.options.Apple:
+		if r.Apple == "" {
+			return "UNKNUNKN"
+		}
+		return r.Apple
+	case fi.options.Extension:
+		if len(r.Extensions) == 0 {
+			return "???"
+		}
+		return strings.Join(r.Extensions, "/")
+	case fi.options.MimeType && fi.options.MimeEncoding:
+		return r.MimeType + "; charset=" + r.Encoding
+	case fi.options.MimeType:
+		return r.MimeType
+	case fi.options.MimeEncoding:
+		return r.Encoding
+	}
+	return r.Desc
 }
 
 // identifyFS identifies a file by its filesystem metadata.
-func identifyFS(info os.FileInfo) string {
+func identifyFS(info os.FileInfo) Result {
 	mode := info.Mode()
+	return Result{Desc: describeFS(mode), MimeType: fsMimeType(mode), Encoding: "binary", Source: SourceFS}
+}
+
+// emptyFileResult is the Result for a zero-length regular file.
+func emptyFileResult() Result {
+	return Result{Desc: "empty", MimeType: "inode/x-empty", Encoding: "binary", Source: SourceFS}
+}
+
+// fsMimeType returns the inode/* MIME type file(1) -i reports for a
+// non-regular file mode.
+func fsMimeType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "inode/directory"
+	case mode&os.ModeSymlink != 0:
+		return "inode/symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "inode/fifo"
+	case mode&os.ModeSocket != 0:
+		return "inode/socket"
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			return "inode/chardevice"
+		}
+		return "inode/blockdevice"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// describeFS returns the description for a non-regular file mode.
+func describeFS(mode os.FileMode) string {
 	switch {
 	case mode.IsDir():
 		return "directory"
@@ -227,6 +450,12 @@ func identifyFS(info os.FileInfo) string {
 	}
 }
 
+// Diagnostics returns the problems found while loading the magic rules,
+// such as regex patterns that do not compile.
+func (fi *FileIdentifier) Diagnostics() []Diagnostic {
+	return fi.set.Diagnostics
+}
+
 // ListEntry represents a magic entry for the -l flag.
 type ListEntry struct {
 	Strength int
@@ -1,74 +1,247 @@
 package magic
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf16"
 )
 
 // Matcher performs pattern matching against a file buffer using magic rules.
+// A Matcher is immutable once created and safe for concurrent use; per-call
+// state lives in a matchState.
 type Matcher struct {
-	set      *MagicSet
-	depth    int         // recursion depth for indirect type
-	fileMode os.FileMode // file permission bits for ${x?...} expansion
+	set    *MagicSet
+	limits limits
 }
 
-const maxIndirectDepth = 16
+// matchState holds the state of a single identification call.
+type matchState struct {
+	*Matcher
+	depth     int         // recursion depth for indirect type
+	nameDepth int         // recursion depth for use of named rules
+	swap      bool        // byte order of tests is swapped, within "use ^name"
+	fileMode  os.FileMode // file permission bits for ${x?...} expansion
+
+	done <-chan struct{} // ctx.Done(), nil if the call cannot be canceled
+	ctx  context.Context
+	err  error // ctx.Err() once cancellation has been observed, or a *LimitError
+
+	ra randomAccess // access to the input beyond the in-memory buffer
+
+	// Scratch storage, kept across calls while the state is pooled.
+	levels   []levelState   // continuation levels of the groups being matched
+	descs    []*descBuffer  // free description buffers
+	records  []*descRecord  // free description records
+	win      []byte         // buffer for input read past buf, see window
+	filters  []*groupFilter // free group filters
+	cancelFn func() bool    // s.canceled, bound once
+}
+
+// randomAccess gives the matcher access to the whole input when the buffer
+// being matched holds only its leading bytes. Buffer offsets are relative
+// to base, which is non-zero while matching an indirect sub-input.
+type randomAccess struct {
+	r      io.ReaderAt  // nil if the buffer is the whole input
+	stream *streamInput // r, if the input is a stream read as rules need it
+	base   int64        // input offset of buf[0]
+	size   int64        // size of the whole input; for a stream, its limit
+}
 
-// NewMatcher creates a new Matcher with the given magic rule set.
+// NewMatcher creates a new Matcher with the given magic rule set and
+// file(1)'s default evaluation limits.
 func NewMatcher(set *MagicSet) *Matcher {
+	return newMatcher(set, defaultLimits)
+}
+
+func newMatcher(set *MagicSet, lim limits) *Matcher {
 	if len(set.Groups) == 0 && len(set.Entries) > 0 {
 		set.buildGroups()
 	}
-	return &Matcher{set: set}
+	return &Matcher{set: set, limits: lim}
+}
+
+// canceled reports whether the call's context is done, recording its error.
+// Once it returns true, matching unwinds and the partial result is discarded.
+func (s *matchState) canceled() bool {
+	if s.err != nil {
+		return true
+	}
+	select {
+	case <-s.done:
+		s.err = s.ctx.Err()
+		return true
+	default:
+		return false
+	}
+}
+
+// textWindow returns the leading part of buf examined to detect its text
+// encoding.
+func (s *matchState) textWindow(buf []byte) []byte {
+	return encodingWindow(buf, s.limits.encoding)
+}
+
+// fail stops matching with err, which the call reports instead of a result.
+func (s *matchState) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
 }
 
 // MatchWithMode identifies the type of the given buffer, using file mode for ${x?...} expansion.
 func (m *Matcher) MatchWithMode(buf []byte, mode os.FileMode) string {
-	m.fileMode = mode
-	return m.Match(buf)
+	return m.MatchResultWithMode(buf, mode).Desc
 }
 
 // Match identifies the type of the given buffer.
 func (m *Matcher) Match(buf []byte) string {
+	return m.MatchResult(buf).Desc
+}
+
+// MatchResult identifies the type of the given buffer and reports which
+// phase and rule produced the description.
+func (m *Matcher) MatchResult(buf []byte) Result {
+	return m.MatchResultWithMode(buf, 0)
+}
+
+// MatchResultWithMode is like MatchResult, using file mode for ${x?...} expansion.
+// If matching exceeds an evaluation limit, the description is the error as
+// file(1) prints it.
+func (m *Matcher) MatchResultWithMode(buf []byte, mode os.FileMode) Result {
+	result, err := m.MatchResultContext(context.Background(), buf, mode)
+	if err != nil {
+		return Result{Desc: errorDesc(err)}
+	}
+	return result
+}
+
+// errorDesc is the description file(1) prints for an input it failed to
+// identify.
+func errorDesc(err error) string {
+	return "ERROR: " + err.Error()
+}
+
+// MatchResultContext is like MatchResultWithMode but stops early and returns
+// ctx.Err() if ctx is canceled. Cancellation is checked between rule groups
+// and periodically inside long search scans.
+func (m *Matcher) MatchResultContext(ctx context.Context, buf []byte, mode os.FileMode) (Result, error) {
+	return m.MatchReaderAt(ctx, buf, nil, 0, mode)
+}
+
+// MatchReaderAt is like MatchResultContext for an input of the given size
+// whose leading bytes are buf. Rules that read past buf, including negative
+// offsets measured from the end of the input, go through r. If r is nil,
+// buf is the whole input. Exceeding an evaluation limit returns a
+// *LimitError.
+func (m *Matcher) MatchReaderAt(ctx context.Context, buf []byte, r io.ReaderAt, size int64, mode os.FileMode) (Result, error) {
+	return m.matchInput(ctx, buf, randomAccess{r: r, size: size}, mode)
+}
+
+// matchInput is MatchReaderAt for an input whose bytes past buf are
+// available through ra.
+func (m *Matcher) matchInput(ctx context.Context, buf []byte, ra randomAccess, mode os.FileMode) (Result, error) {
+	s := m.newState(ctx, mode)
+	defer s.release()
+	if ra.r != nil && ra.size > int64(len(buf)) {
+		s.ra = ra
+	}
+	if s.canceled() {
+		return Result{}, s.err
+	}
+	result := s.identify(buf)
+	if s.err != nil {
+		return Result{}, s.err
+	}
+	// MIME types use ${x?...} like descriptions (e.g. the ELF pie/shared
+	// library rules).
+	if strings.Contains(result.MimeType, "${") {
+		result.MimeType = varexpand(result.MimeType, s.fileMode)
+	}
+	result.Encoding = detectCharset(s.textWindow(buf))
+	return result, nil
+}
+
+// identify runs the soft magic, JSON and text phases in order and returns
+// the first result.
+func (s *matchState) identify(buf []byte) Result {
 	// Try soft magic first
-	if result := m.matchSoftMagic(buf); result != "" {
+	if result := s.matchSoftMagic(buf); result.Desc != "" {
+		if result.MimeType == "" {
+			result.MimeType = defaultMimeType(s.textWindow(buf))
+		}
 		return result
 	}
 
-	// Try JSON detection (like is_json.c)
+	// Try JSON detection (like is_json.c). It examines the in-memory
+	// prefix of a file, which a stream holds only as far as rules read it;
+	// it is read further if the content may be JSON.
+	if s.ra.stream != nil {
+		if d := jsonStart(buf); len(d) == 0 || d[0] == '{' || d[0] == '[' {
+			buf = s.ra.stream.prefix(min(prefixMax, s.limits.bytes))
+		}
+	}
 	if result := detectJSON(buf); result != "" {
-		return result
+		return Result{Desc: result, MimeType: jsonMimeType(result), Source: SourceJSON}
 	}
 
 	// Try text magic: detect encoding, decode if needed, run TEXTTEST rules
 	// This is the ascmagic phase — text test rules run here, not in soft magic.
-	if enc := detectEncoding(buf); enc != "" && enc != "data" {
+	// Like file(1), it examines only the encoding window of the buffer.
+	text := s.textWindow(buf)
+	if enc := detectEncoding(text); enc != "" && enc != "data" {
+		if enc == "empty" {
+			return Result{Desc: enc, MimeType: "application/x-empty", Source: SourceText}
+		}
 		// For UTF-16/UTF-32, decode and try text magic on decoded content
-		if decoded := decodeUTF16(buf); decoded != nil {
-			if textResult := m.matchTextMagic(decoded); textResult != "" {
-				return appendTextEncoding(textResult, enc)
-			}
-		} else {
-			// For ASCII/UTF-8, try text magic on original buffer
-			if textResult := m.matchTextMagic(buf); textResult != "" {
-				return appendTextEncoding(textResult, enc)
+		if decoded := decodeUTF16(text); decoded != nil {
+			text = decoded
+		}
+		// Text rules see only text, so offsets past it and from its end
+		// must not reach the input through s.ra.
+		saved := s.ra
+		s.ra = randomAccess{}
+		textResult := s.matchTextMagic(text)
+		s.ra = saved
+		if textResult.Desc != "" {
+			textResult.Desc = appendTextEncoding(textResult.Desc, enc)
+			if textResult.MimeType == "" {
+				textResult.MimeType = "text/plain"
 			}
+			return textResult
 		}
-		return enc
+		return Result{Desc: enc, MimeType: "text/plain", Source: SourceText}
 	}
 
-	return "data"
+	return Result{Desc: "data", MimeType: "application/octet-stream", Source: SourceData}
+}
+
+// defaultMimeType returns the MIME type file(1) -i falls back to when the
+// matching rule has no !:mime annotation.
+func defaultMimeType(buf []byte) string {
+	if enc, _, _ := classifyEncoding(buf); enc != encBinary && enc != encEmpty {
+		return "text/plain"
+	}
+	return "application/octet-stream"
 }
 
 // MatchAll identifies the type of the given buffer, returning all matches
-// (like C's file -k flag). Results are joined with "\012- " separator.
+// (like C's file -k flag). Results are joined with "\\012- " separator.
 func (m *Matcher) MatchAll(buf []byte) string {
-	results := m.matchSoftMagicAll(buf)
+	return m.MatchAllWithMode(buf, 0)
+}
+
+// MatchAllWithMode is like MatchAll, using file mode for ${x?...} expansion.
+func (m *Matcher) MatchAllWithMode(buf []byte, mode os.FileMode) string {
+	s := m.newState(context.Background(), mode)
+	defer s.release()
+	results := s.matchSoftMagicAll(buf)
 
 	// Try JSON detection
 	if len(results) == 0 {
@@ -78,11 +251,12 @@ func (m *Matcher) MatchAll(buf []byte) string {
 	}
 
 	// Try text encoding
-	if enc := detectEncoding(buf); enc != "" && enc != "data" {
+	text := s.textWindow(buf)
+	if enc := detectEncoding(text); enc != "" && enc != "data" {
 		if len(results) == 0 {
-			if decoded := decodeUTF16(buf); decoded != nil {
-				if textResult := m.matchTextMagic(decoded); textResult != "" {
-					results = append(results, appendTextEncoding(textResult, enc))
+			if decoded := decodeUTF16(text); decoded != nil {
+				if textResult := s.matchTextMagic(decoded); textResult.Desc != "" {
+					results = append(results, appendTextEncoding(textResult.Desc, enc))
 				}
 			}
 			if len(results) == 0 {
@@ -96,12 +270,15 @@ func (m *Matcher) MatchAll(buf []byte) string {
 	} else if len(results) == 0 {
 		results = append(results, "data")
 	}
+	if s.err != nil {
+		return errorDesc(s.err)
+	}
 
 	return strings.Join(results, "\\012- ")
 }
 
 // matchSoftMagicAll returns all matching soft magic results (for -k mode).
-func (m *Matcher) matchSoftMagicAll(buf []byte) []string {
+func (s *matchState) matchSoftMagicAll(buf []byte) []string {
 	type matchResult struct {
 		result   string
 		score    int
@@ -109,15 +286,24 @@ func (m *Matcher) matchSoftMagicAll(buf []byte) []string {
 	}
 	var matches []matchResult
 
-	isBinary := isBinaryData(buf)
-	for _, group := range m.set.Groups {
+	isBinary := isBinaryData(s.textWindow(buf))
+	filter := s.getFilter(buf)
+	defer s.putFilter(filter)
+	out := s.getRecord()
+	defer s.putRecord(out)
+	for i := range s.set.Groups {
+		if s.canceled() {
+			break
+		}
+		group := &s.set.Groups[i]
 		top := group.Entries[0]
-		if top.Type == TypeName {
+		if top.Type == TypeName || !filter.may(i) {
 			continue
 		}
-		result, score := m.matchGroupScoredWithBinary(buf, &group, 0, isBinary)
-		if result != "" {
-			matches = append(matches, matchResult{result, score, group.Strength})
+		out.reset()
+		score := s.matchGroupScoredWithBinary(out, buf, group, 0, isBinary, nil)
+		if out.printed {
+			matches = append(matches, matchResult{s.renderString(out), score, group.Strength})
 		}
 	}
 
@@ -131,18 +317,31 @@ func (m *Matcher) matchSoftMagicAll(buf []byte) []string {
 
 // matchSoftMagic tries to match against soft magic rules only.
 // It evaluates all groups and returns the result from the best match.
-func (m *Matcher) matchSoftMagic(buf []byte) string {
-	bestResult := ""
+// The returned Result has an empty Desc when nothing matched.
+func (s *matchState) matchSoftMagic(buf []byte) Result {
+	// Descriptions are recorded in scratch records; the best one so far is
+	// kept by swapping, and only the winner is formatted.
+	best, out := s.getRecord(), s.getRecord()
+	defer func() { s.putRecord(best); s.putRecord(out) }()
 	bestScore := 0
 	bestMime := ""
 	bestIsTextTest := false
 	var bestTop *MagicEntry
+	var bestGroup *MagicGroup
+	var bestMeta ruleMeta
 
 	// Cache isBinaryData result: detectEncoding scans the entire buffer,
 	// so calling it per-group is O(groups × bufsize). Cache it once.
-	isBinary := isBinaryData(buf)
+	isBinary := isBinaryData(s.textWindow(buf))
 
-	for _, group := range m.set.Groups {
+	// Only the groups whose top-level test can match need to be evaluated.
+	filter := s.getFilter(buf)
+	defer s.putFilter(filter)
+	for i := range s.set.Groups {
+		if s.canceled() {
+			break
+		}
+		group := &s.set.Groups[i]
 		top := group.Entries[0]
 		if top.Type == TypeName {
 			continue
@@ -153,14 +352,21 @@ func (m *Matcher) matchSoftMagic(buf []byte) string {
 		if top.StrFlags&StrFlagTextTest != 0 || isAutoTextTest(top) {
 			continue
 		}
+		if !filter.may(i) {
+			continue
+		}
 
-		result, score := m.matchGroupScoredWithBinary(buf, &group, 0, isBinary)
-		if result != "" && score > bestScore {
-			bestResult = result
+		var meta ruleMeta
+		out.reset()
+		score := s.matchGroupScoredWithBinary(out, buf, group, 0, isBinary, &meta)
+		if out.printed && score > bestScore {
+			best, out = out, best
 			bestScore = score
 			bestMime = top.MimeType
 			bestIsTextTest = top.StrFlags&StrFlagTextTest != 0
 			bestTop = top
+			bestGroup = group
+			bestMeta = meta
 			// If we have a high-quality match (non-default, with continuations),
 			// and we've checked all groups with equal or higher strength, stop early
 			if score >= 100 && group.Strength < bestScore {
@@ -169,32 +375,36 @@ func (m *Matcher) matchSoftMagic(buf []byte) string {
 		}
 	}
 
+	if bestGroup == nil {
+		return Result{}
+	}
+	bestResult := s.renderString(best)
+
 	// Append text encoding detection (like C's file_ascmagic)
 	// Also append for search/regex rules with text patterns (C auto-classifies these as TEXTTEST)
-	if bestResult != "" {
-		shouldAppendText := strings.HasPrefix(bestMime, "text/") || bestIsTextTest
-		if !shouldAppendText && bestTop != nil && isAutoTextTest(bestTop) {
-			shouldAppendText = true
-		}
-		if shouldAppendText {
-			if enc := detectEncoding(buf); enc != "" && enc != "data" {
-				bestResult = appendTextEncoding(bestResult, enc)
-			}
+	shouldAppendText := strings.HasPrefix(bestMime, "text/") || bestIsTextTest
+	if !shouldAppendText && bestTop != nil && isAutoTextTest(bestTop) {
+		shouldAppendText = true
+	}
+	if shouldAppendText {
+		if enc := detectEncoding(s.textWindow(buf)); enc != "" && enc != "data" {
+			bestResult = appendTextEncoding(bestResult, enc)
 		}
 	}
-
-	return bestResult
+	return groupResult(bestResult, bestGroup, &bestMeta, SourceSoftMagic)
 }
 
-// matchGroupScored tries to match a group and returns (result, score).
+// matchGroupScored tries to match a group, recording its description in out,
+// and returns its score. Nothing is recorded if the group does not match.
 // Score reflects match quality: higher = more specific continuations matched.
-func (m *Matcher) matchGroupScored(buf []byte, group *MagicGroup, baseOffset int) (string, int) {
-	return m.matchGroupScoredWithBinary(buf, group, baseOffset, isBinaryData(buf))
+// If meta is non-nil, it receives the annotations of the matched entries.
+func (s *matchState) matchGroupScored(out *descRecord, buf []byte, group *MagicGroup, baseOffset int, meta *ruleMeta) int {
+	return s.matchGroupScoredWithBinary(out, buf, group, baseOffset, isBinaryData(s.textWindow(buf)), meta)
 }
 
 // matchGroupScoredWithBinary is like matchGroupScored but accepts a pre-computed
 // isBinary flag to avoid repeatedly scanning the buffer.
-func (m *Matcher) matchGroupScoredWithBinary(buf []byte, group *MagicGroup, baseOffset int, isBinary bool) (string, int) {
+func (s *matchState) matchGroupScoredWithBinary(out *descRecord, buf []byte, group *MagicGroup, baseOffset int, isBinary bool, meta *ruleMeta) int {
 	top := group.Entries[0]
 
 	// Check text/binary test flags: /t means only match text files, /b only binary
@@ -203,50 +413,48 @@ func (m *Matcher) matchGroupScoredWithBinary(buf []byte, group *MagicGroup, base
 	hasBT := top.StrFlags&StrFlagBinaryTest != 0
 	if hasTT && !hasBT {
 		if isBinary {
-			return "", 0
+			return 0
 		}
 	}
 	if hasBT && !hasTT {
 		if !isBinary {
-			return "", 0
+			return 0
 		}
 	}
 
-	matched, val, matchedOffset := m.tryMatch(buf, top, baseOffset)
+	matched, val, matchedOffset := s.tryMatch(buf, top, baseOffset)
 	if !matched {
-		return "", 0
+		return 0
 	}
 
-	var out strings.Builder
-	out.WriteString(m.formatDesc(top.Desc, val))
+	s.record(out, descTop, top, val)
+	meta.add(top)
 
-	contScore := m.processContinuations(&out, buf, group.Entries[1:], baseOffset, matchedOffset)
+	contScore := s.processContinuations(out, buf, group.Entries[1:], baseOffset, matchedOffset, meta)
 
 	// Score is primarily group strength. Continuations are a minor tiebreaker only,
 	// never enough to override a strength difference between groups.
 	// In C file, match priority is determined by strength alone.
-	score := group.Strength*100 + contScore
-
-	return out.String(), score
+	return group.Strength*100 + contScore
 }
 
 // processContinuations handles continuation entries.
 // Returns the number of non-default continuations that matched (for scoring).
-func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries []*MagicEntry, baseOffset int, parentOffset int) int {
+func (s *matchState) processContinuations(out *descRecord, buf []byte, entries []*MagicEntry, baseOffset int, parentOffset int, meta *ruleMeta) int {
 	score := 0
-	type levelState struct {
-		matched       bool
-		matchedOffset int
-		siblingMatch  bool // for default type
+	depth := 1
+	for _, cont := range entries {
+		depth = max(depth, int(cont.ContLevel)+1)
 	}
-	levels := make([]levelState, 64) // max nesting depth
+	levels := s.pushLevels(depth)
+	defer s.popLevels(depth)
 	levels[0] = levelState{matched: true, matchedOffset: parentOffset}
 
 	for _, cont := range entries {
-		cl := int(cont.ContLevel)
-		if cl >= len(levels) {
-			continue
+		if s.canceled() {
+			break
 		}
+		cl := int(cont.ContLevel)
 
 		// Check if parent level matched
 		if cl > 0 && !levels[cl-1].matched {
@@ -255,13 +463,9 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 
 		// Handle 'use' type — call a named rule set
 		if cont.Type == TypeUse {
-			name := cont.Desc
-			if name == "" && len(cont.Value.Str) > 0 {
-				name = string(cont.Value.Str)
-			}
-			groupIdx, ok := m.set.NamedRules[name]
+			groupIdx, swap, ok := s.set.lookupUse(cont)
 			if ok {
-				namedGroup := &m.set.Groups[groupIdx]
+				namedGroup := &s.set.Groups[groupIdx]
 				// Calculate use base offset (same logic as tryMatch)
 				useBase := baseOffset + int(cont.Offset)
 				if cont.Flag&FlagOffAdd != 0 {
@@ -271,7 +475,7 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 				}
 				// Resolve indirect offset if needed
 				if cont.Flag&FlagIndir != 0 {
-					resolved, err := m.resolveIndirect(buf, useBase, cont)
+					resolved, err := s.resolveIndirect(buf, useBase, cont)
 					if err == nil {
 						// INDIROFFADD: add parent offset to result
 						if cont.Flag&FlagOffAdd != 0 && cl > 0 {
@@ -282,28 +486,23 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 						continue
 					}
 				}
-				useResult := m.matchNamedGroup(buf, namedGroup, useBase)
-				if useResult != "" {
-					// Check if the named group's first continuation has \b prefix
-					// in its description, meaning the result should be appended without space
-					hasBackspace := false
-					for _, e := range namedGroup.Entries[1:] {
-						if e.Desc != "" {
-							hasBackspace = strings.HasPrefix(e.Desc, "\\b")
-							break
-						}
-					}
-					// Handle ": " prefix: replace entire previous output with specific identification.
-					// In OLE2/CDF magic rules, ": Type" means "this is a more specific identification
-					// that replaces the generic type". C's file handles this via a dedicated CDF parser.
-					if strings.HasPrefix(useResult, ": ") {
-						out.Reset()
-						out.WriteString(useResult[2:])
-					} else if hasBackspace || (len(useResult) > 0 && (useResult[0] == ',' || useResult[0] == '.' || useResult[0] == ';' || useResult[0] == ':')) {
-						out.WriteString(useResult)
-					} else {
-						appendDesc(out, useResult)
-					}
+				// Like file(1), a use past the end of the input matches nothing.
+				if useBase < 0 || !s.inputHas(buf, useBase) {
+					continue
+				}
+				if s.nameDepth >= s.limits.name {
+					s.fail(&LimitError{Param: "name", Limit: s.limits.name})
+					break
+				}
+				prevLevel := meta.enter(cl)
+				mark, printed := out.beginUse(namedGroup)
+				s.nameDepth++
+				s.swap = s.swap != swap
+				s.matchNamedGroup(out, buf, namedGroup, useBase, meta)
+				s.swap = s.swap != swap
+				s.nameDepth--
+				meta.leave(prevLevel)
+				if out.endUse(mark, printed) {
 					levels[cl] = levelState{matched: true, matchedOffset: useBase, siblingMatch: true}
 					score++
 				}
@@ -316,9 +515,8 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 		// C's file: FILE_CLEAR sets got_match=0, then falls through to output.
 		if cont.Type == TypeClear {
 			levels[cl] = levelState{matched: true, matchedOffset: levels[cl].matchedOffset, siblingMatch: false}
-			if cont.Desc != "" {
-				appendDesc(out, m.formatDesc(cont.Desc, Value{}))
-			}
+			meta.add(cont)
+			s.record(out, descEntry, cont, Value{})
 			score++
 			continue
 		}
@@ -330,7 +528,8 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 				levels[cl] = levelState{matched: false, matchedOffset: levels[cl].matchedOffset, siblingMatch: levels[cl].siblingMatch}
 				continue // skip default if a sibling already matched
 			}
-			appendDesc(out, m.formatDesc(cont.Desc, Value{}))
+			s.record(out, descEntry, cont, Value{})
+			meta.add(cont)
 			levels[cl] = levelState{matched: true, matchedOffset: levels[cl-1].matchedOffset, siblingMatch: true}
 			continue
 		}
@@ -342,18 +541,30 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 				indirectOffset = levels[cl-1].matchedOffset + int(cont.Offset)
 			}
 			if cont.Flag&FlagIndir != 0 {
-				resolved, err := m.resolveIndirect(buf, indirectOffset, cont)
+				resolved, err := s.resolveIndirect(buf, indirectOffset, cont)
 				if err == nil {
 					indirectOffset = resolved
 				}
 			}
-			if indirectOffset >= 0 && indirectOffset < len(buf) && m.depth < maxIndirectDepth {
-				m.depth++
-				subResult := m.matchSoftMagic(buf[indirectOffset:])
-				m.depth--
-				if subResult != "" {
-					appendDesc(out, m.formatDesc(cont.Desc, Value{}))
-					appendDesc(out, subResult)
+			if indirectOffset >= 0 && s.inputHas(buf, indirectOffset+1) {
+				if s.depth >= s.limits.indir {
+					s.fail(&LimitError{Param: "indir", Limit: s.limits.indir})
+					break
+				}
+				s.depth++
+				saved := s.ra
+				sub, bp := s.subInput(buf, indirectOffset)
+				subResult := s.matchSoftMagic(sub)
+				if bp != nil {
+					readBufPool.Put(bp)
+				}
+				s.ra = saved
+				s.depth--
+				if subResult.Desc != "" {
+					s.record(out, descEntry, cont, Value{})
+					out.recordText(subResult.Desc)
+					meta.add(cont)
+					meta.addResult(subResult, cl)
 					levels[cl] = levelState{matched: true, matchedOffset: indirectOffset, siblingMatch: true}
 				}
 			}
@@ -367,11 +578,15 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 			effectiveBase = levels[cl-1].matchedOffset
 		}
 
-		contMatched, contVal, contOffset := m.tryMatch(buf, cont, effectiveBase)
+		contMatched, contVal, contOffset := s.tryMatch(buf, cont, effectiveBase)
 		if contMatched {
-			desc := m.formatDesc(cont.Desc, contVal)
-			appendDesc(out, desc)
+			s.record(out, descEntry, cont, contVal)
+			meta.add(cont)
 			levels[cl] = levelState{matched: true, matchedOffset: contOffset, siblingMatch: true}
+			if cont.Type == TypeDER && cl > 0 {
+				// The next &0 sibling reads the element after this one.
+				levels[cl-1].matchedOffset = int(contVal.Numeric)
+			}
 			score++
 			// Reset deeper levels
 			for k := cl + 1; k < len(levels); k++ {
@@ -388,26 +603,30 @@ func (m *Matcher) processContinuations(out *strings.Builder, buf []byte, entries
 	return score
 }
 
-// matchNamedGroup matches a named group (called via 'use') and returns formatted output.
-func (m *Matcher) matchNamedGroup(buf []byte, group *MagicGroup, baseOffset int) string {
+// matchNamedGroup matches a named group (called via 'use') and records its
+// output in out.
+func (s *matchState) matchNamedGroup(out *descRecord, buf []byte, group *MagicGroup, baseOffset int, meta *ruleMeta) {
 	if len(group.Entries) <= 1 {
-		return ""
+		return
 	}
 
-	var out strings.Builder
 	// Include the name entry's description if present (set when magic has explicit desc)
 	top := group.Entries[0]
-	if top.Desc != "" {
-		out.WriteString(m.formatDesc(top.Desc, Value{}))
-	}
+	s.record(out, descTop, top, Value{})
 	// Named groups start from their continuations (skip the 'name' entry itself)
-	_ = m.processContinuations(&out, buf, group.Entries[1:], baseOffset, baseOffset)
-	return out.String()
+	_ = s.processContinuations(out, buf, group.Entries[1:], baseOffset, baseOffset, meta)
 }
 
 // tryMatch tests a single entry against the buffer.
 // Returns (matched, value, offset after match).
-func (m *Matcher) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool, Value, int) {
+func (s *matchState) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool, Value, int) {
+	if s.swap {
+		if t := swapType(entry.Type); t != entry.Type {
+			swapped := *entry
+			swapped.Type = t
+			entry = &swapped
+		}
+	}
 	offset := baseOffset + int(entry.Offset)
 
 	// Handle relative offset (OFFADD flag)
@@ -419,7 +638,7 @@ func (m *Matcher) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool,
 	if entry.Flag&FlagIndir != 0 {
 		// Use the computed offset (which already includes baseOffset for relative)
 		// as the base for the indirect read
-		resolved, err := m.resolveIndirect(buf, offset, entry)
+		resolved, err := s.resolveIndirect(buf, offset, entry)
 		if err != nil {
 			return false, Value{}, 0
 		}
@@ -433,7 +652,7 @@ func (m *Matcher) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool,
 
 	// Handle negative offset (from end of file, like C's OFFNEGATIVE)
 	if entry.Flag&FlagNegative != 0 && offset < 0 {
-		offset = len(buf) + offset
+		offset = s.inputLen(buf) + offset
 	}
 
 	if offset < 0 {
@@ -445,16 +664,41 @@ func (m *Matcher) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool,
 		return true, Value{}, offset
 	}
 
-	if offset >= len(buf) {
+	if !s.inputHas(buf, offset+1) {
 		return false, Value{}, 0
 	}
 
 	// Handle regex type
 	if entry.Type == TypeRegex {
-		return m.tryMatchRegex(buf, offset, entry)
+		return s.tryMatchRegex(buf, offset, entry)
+	}
+	if entry.Type == TypeDER {
+		return s.tryMatchDER(buf, offset, entry)
 	}
 
-	val, err := extractValue(buf, offset, entry)
+	data, dataOff := s.window(buf, offset, readSize(entry, s.limits))
+	var val Value
+	var err error
+	if entry.Type == TypeSearch {
+		val, err = extractSearch(data, dataOff, entry, s.cancelFn)
+	} else {
+		val, err = extractValue(data, dataOff, entry)
+	}
+	// Positions reported in Numeric are relative to data; make them
+	// relative to buf.
+	if shift := uint64(offset - dataOff); shift != 0 && err == nil {
+		switch entry.Type {
+		case TypeSearch, TypeOffset:
+			val.Numeric += shift
+		case TypePString:
+			if val.Numeric > 0 {
+				val.Numeric += shift
+			}
+		}
+	}
+	if err == errCanceled {
+		return false, Value{}, 0
+	}
 	if err != nil {
 		// For search type with '!' relation, not-found means match succeeds
 		// (C behavior: FILE_SEARCH with '!' matches when pattern is absent)
@@ -467,13 +711,17 @@ func (m *Matcher) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool,
 	// Apply numeric mask
 	if entry.HasMask && !val.IsString {
 		val.Numeric = applyMask(val.Numeric, entry.NumMask, entry.MaskOp)
+		// The result keeps the width of the type, as in file(1).
+		if w := intWidth(entry.Type); w > 0 && w < 8 {
+			val.Numeric &= 1<<(8*w) - 1
+		}
 	}
 
 	if !compare(val, entry) {
 		return false, Value{}, 0
 	}
 
-	// Calculate offset after match (before date formatting which changes IsString)
+	// Calculate offset after match
 	var matchEnd int
 	if isDateType(entry.Type) {
 		matchEnd = offset + typeSize(entry.Type)
@@ -494,79 +742,70 @@ func (m *Matcher) tryMatch(buf []byte, entry *MagicEntry, baseOffset int) (bool,
 				matchEnd = offset + len(entry.Value.Str)
 			}
 		}
+	} else if entry.Type == TypeOctal {
+		_, n := parseOctal(data[dataOff:])
+		matchEnd = offset + n
 	} else {
 		matchEnd = offset + typeSize(entry.Type)
 	}
 
-	// Convert date types to formatted strings for display (after matchEnd calculation)
-	if isDateType(entry.Type) {
-		val = formatDateValue(val, entry)
-	}
-
-	// Convert GUID to formatted string for display
-	if entry.Type == TypeGUID && val.IsString && len(val.Str) == 16 {
-		formatted := formatGUID(val.Str)
-		val = Value{Str: []byte(formatted), IsString: true}
-	}
-
 	return true, val, matchEnd
 }
 
 // tryMatchRegex matches a regex pattern against the buffer.
-func (m *Matcher) tryMatchRegex(buf []byte, offset int, entry *MagicEntry) (bool, Value, int) {
-	pattern := string(entry.Value.Str)
-	// Strip leading = if present
-	pattern = strings.TrimPrefix(pattern, "=")
-	// Enable multiline mode (like C's REG_NEWLINE) so ^ matches at line boundaries
-	if strings.Contains(pattern, "^") {
-		pattern = "(?m)" + pattern
+func (s *matchState) tryMatchRegex(buf []byte, offset int, entry *MagicEntry) (bool, Value, int) {
+	// The pattern is compiled when the rules are loaded; one that does not
+	// compile never matches.
+	re := entry.re
+	if re == nil {
+		return false, Value{}, 0
 	}
 
-	// Determine search range
-	searchRange := int(entry.StrRange)
-	if searchRange == 0 {
-		searchRange = 8192
+	// Like file(1), the range is in bytes, or in lines of up to 80 bytes,
+	// and the search never reads more than the regex limit.
+	lineCount := 0
+	readLen := int(entry.StrRange)
+	if entry.StrFlags&StrFlagRegexLines != 0 {
+		lineCount = readLen
+		readLen *= 80
+	}
+	if readLen == 0 || readLen > s.limits.regex {
+		readLen = s.limits.regex
 	}
+	data, dataOff := s.window(buf, offset, readLen)
+	region := data[dataOff:min(dataOff+readLen, len(data))]
 
-	var region string
-	if entry.StrFlags&StrFlagRegexLines != 0 {
+	if lineCount > 0 {
 		// Range is in lines, not bytes — exclude trailing newline
-		lineCount := searchRange
-		data := buf[offset:]
 		pos := 0
-		for n := 0; n < lineCount && pos < len(data); n++ {
+		for n := 0; n < lineCount && pos < len(region); n++ {
 			nl := 0
-			for nl+pos < len(data) && data[pos+nl] != '\n' {
+			for nl+pos < len(region) && region[pos+nl] != '\n' {
 				nl++
 			}
 			pos += nl
-			if pos < len(data) && data[pos] == '\n' {
+			if pos < len(region) && region[pos] == '\n' {
 				if n < lineCount-1 {
 					pos++ // include newline between lines, but not at end
 				}
 			}
 		}
-		region = string(data[:pos])
-	} else {
-		end := offset + searchRange
-		if end > len(buf) {
-			end = len(buf)
-		}
-		region = string(buf[offset:end])
+		region = region[:pos]
 	}
 
 	// C's file uses C strings (null-terminated) for regex matching.
 	// Truncate at first null byte to match C behavior and avoid
 	// false positive matches in binary content.
-	if nullIdx := strings.IndexByte(region, 0); nullIdx >= 0 {
+	if nullIdx := bytes.IndexByte(region, 0); nullIdx >= 0 {
 		region = region[:nullIdx]
 	}
-	re, err := regexp.Compile(pattern)
-	if err != nil {
+	// A single scan is linear in the region size, so checking before it
+	// bounds the work done after cancellation.
+	if s.canceled() {
 		return false, Value{}, 0
 	}
 
-	loc := re.FindStringIndex(region)
+	loc := re.FindIndex(region)
 	if loc == nil {
 		return false, Value{}, 0
 	}
@@ -577,7 +816,7 @@ func (m *Matcher) tryMatchRegex(buf []byte, offset int, entry *MagicEntry) (bool
 	if entry.StrFlags&StrFlagRegexStart != 0 {
 		matchEnd = offset + loc[0]
 	}
-	return true, Value{Str: []byte(matched), IsString: true}, matchEnd
+	return true, Value{Str: matched[:len(matched):len(matched)], IsString: true}, matchEnd
 }
 
 // applyMask applies a mask operation to a numeric value.
@@ -620,7 +859,8 @@ func typeSize(t FileType) int {
 	case TypeLong, TypeBELong, TypeLELong, TypeMELong,
 		TypeDate, TypeBEDate, TypeLEDate, TypeMEDate,
 		TypeLDate, TypeBELDate, TypeLELDate, TypeMELDate,
-		TypeFloat, TypeBEFloat, TypeLEFloat:
+		TypeFloat, TypeBEFloat, TypeLEFloat,
+		TypeBEID3, TypeLEID3:
 		return 4
 	case TypeQuad, TypeBEQuad, TypeLEQuad,
 		TypeDouble, TypeBEDouble, TypeLEDouble,
@@ -635,42 +875,132 @@ func typeSize(t FileType) int {
 	}
 }
 
+// inputLen returns the length of the input buf starts, which exceeds
+// len(buf) when the rest of the input is available through s.ra. A stream
+// is read to its end to find it.
+func (s *matchState) inputLen(buf []byte) int {
+	switch {
+	case s.ra.r == nil:
+		return len(buf)
+	case s.ra.stream != nil:
+		return int(s.ra.stream.Size() - s.ra.base)
+	}
+	return int(s.ra.size - s.ra.base)
+}
+
+// inputEnd returns end, or the length of the input buf starts if that is
+// shorter. A stream is read only as far as end.
+func (s *matchState) inputEnd(buf []byte, end int) int {
+	switch {
+	case end <= len(buf) || s.ra.r == nil:
+		return min(end, len(buf))
+	case s.ra.stream != nil:
+		return min(end, int(int64(s.ra.stream.fill(s.ra.base+int64(end)))-s.ra.base))
+	}
+	return int(min(int64(end), s.ra.size-s.ra.base))
+}
+
+// inputHas reports whether the input buf starts holds at least n bytes.
+func (s *matchState) inputHas(buf []byte, n int) bool {
+	return s.inputEnd(buf, n) == n
+}
+
+// window returns a slice holding the n input bytes at offset and the
+// position of offset within it. Bytes in buf are used in place; when the
+// range extends past buf and the input continues, it is read through s.ra.
+// Near the end of the input fewer than n bytes are available.
+func (s *matchState) window(buf []byte, offset, n int) ([]byte, int) {
+	if offset+n <= len(buf) || s.ra.r == nil {
+		return buf, offset
+	}
+	n = s.inputEnd(buf, offset+n) - offset
+	if n <= 0 || offset+n <= len(buf) {
+		return buf, offset
+	}
+	if cap(s.win) < n {
+		s.win = make([]byte, max(n, 4096))
+	}
+	return s.readInput(s.win[:n], offset), 0
+}
+
+// windowPoolMax is the largest window kept when the matchState is pooled.
+const windowPoolMax = 64 * 1024
+
+// readInput reads the input at offset into data, returning the bytes read.
+func (s *matchState) readInput(data []byte, offset int) []byte {
+	got, _ := s.ra.r.ReadAt(data, s.ra.base+int64(offset))
+	return data[:got]
+}
+
+// subInput returns the input starting at offset, for matching an indirect
+// rule, and moves s.ra to it. The caller saves and restores s.ra. If the
+// offset is past buf, the leading bytes of the sub-input are read into bp,
+// which the caller returns to readBufPool once the rule is matched.
+func (s *matchState) subInput(buf []byte, offset int) (sub []byte, bp *[]byte) {
+	if offset < len(buf) {
+		sub = buf[offset:]
+	} else {
+		// The sub-input is matched while other reads reuse the window
+		// buffer, so it gets its own.
+		bp = getReadBuf(s.inputEnd(buf, offset+s.limits.textPrefix()) - offset)
+		sub = s.readInput(*bp, offset)
+	}
+	if s.ra.r != nil {
+		s.ra.base += int64(offset)
+	}
+	return sub, bp
+}
+
+// readSize returns the number of input bytes extracting entry's value may
+// examine at its offset.
+func readSize(entry *MagicEntry, lim limits) int {
+	slen := len(entry.Value.Str)
+	switch entry.Type {
+	case TypeString:
+		switch {
+		case entry.Relation == 'x' || entry.Relation == '>' || entry.Relation == '<' || entry.Relation == '!':
+			return 8192
+		case entry.StrFlags&(StrFlagOptionalWS|StrFlagCompactWS) != 0:
+			return max(slen*4, 256)
+		}
+		return max(slen, 1)
+	case TypePString:
+		return 4 + 8192
+	case TypeLEString16, TypeBEString16:
+		return max(slen*2, 1024)
+	case TypeSearch:
+		if entry.StrRange == 0 {
+			return lim.bytes
+		}
+		return int(entry.StrRange) + slen*4
+	case TypeOctal:
+		return octalFieldMax
+	}
+	return typeSize(entry.Type)
+}
+
 // resolveIndirect reads the offset value from the file and computes the real offset.
-func (m *Matcher) resolveIndirect(buf []byte, baseOffset int, entry *MagicEntry) (int, error) {
+func (s *matchState) resolveIndirect(buf []byte, baseOffset int, entry *MagicEntry) (int, error) {
 	// Handle negative indirect base (from end of file)
 	if baseOffset < 0 {
-		baseOffset = len(buf) + baseOffset
+		baseOffset = s.inputLen(buf) + baseOffset
 	}
-	if baseOffset < 0 || baseOffset >= len(buf) {
-		return 0, fmt.Errorf("indirect base out of bounds")
+	if baseOffset < 0 || !s.inputHas(buf, baseOffset+1) {
+		return 0, errShortBuffer
 	}
 
-	// For ID3 types, read as BE/LE long then convert syncsafe
-	inType := entry.InType
-	switch inType {
-	case TypeBEID3:
-		inType = TypeBELong
-	case TypeLEID3:
-		inType = TypeLELong
+	indirEntry := &MagicEntry{Type: entry.InType}
+	if s.swap {
+		indirEntry.Type = swapType(entry.InType)
 	}
-
-	indirEntry := &MagicEntry{Type: inType}
-	val, err := extractValue(buf, baseOffset, indirEntry)
+	data, dataOff := s.window(buf, baseOffset, typeSize(entry.InType))
+	val, err := extractValue(data, dataOff, indirEntry)
 	if err != nil {
 		return 0, err
 	}
 
 	offset := int(val.Numeric)
 
-	// Convert ID3 syncsafe integer: 7 bits per byte
-	if entry.InType == TypeBEID3 || entry.InType == TypeLEID3 {
-		v := uint32(offset)
-		offset = int(((v >> 0) & 0x7f) |
-			(((v >> 8) & 0x7f) << 7) |
-			(((v >> 16) & 0x7f) << 14) |
-			(((v >> 24) & 0x7f) << 21))
-	}
-
 	if entry.InOp != 0 {
 		disp := int(entry.InOffset)
 		switch entry.InOp {
@@ -692,6 +1022,56 @@ func (m *Matcher) resolveIndirect(buf []byte, baseOffset int, entry *MagicEntry)
 	return offset, nil
 }
 
+// swapType returns the type that reads like t with the byte order swapped,
+// for the tests of a rule called with "use ^name". Like file(1), only the
+// big- and little-endian types are swapped; native, middle-endian, ID3,
+// UTF-16 and MS-DOS types are not.
+func swapType(t FileType) FileType {
+	switch t {
+	case TypeBEShort:
+		return TypeLEShort
+	case TypeBELong:
+		return TypeLELong
+	case TypeBEDate:
+		return TypeLEDate
+	case TypeBELDate:
+		return TypeLELDate
+	case TypeBEQuad:
+		return TypeLEQuad
+	case TypeBEQDate:
+		return TypeLEQDate
+	case TypeBEQLDate:
+		return TypeLEQLDate
+	case TypeBEQWDate:
+		return TypeLEQWDate
+	case TypeBEFloat:
+		return TypeLEFloat
+	case TypeBEDouble:
+		return TypeLEDouble
+	case TypeLEShort:
+		return TypeBEShort
+	case TypeLELong:
+		return TypeBELong
+	case TypeLEDate:
+		return TypeBEDate
+	case TypeLELDate:
+		return TypeBELDate
+	case TypeLEQuad:
+		return TypeBEQuad
+	case TypeLEQDate:
+		return TypeBEQDate
+	case TypeLEQLDate:
+		return TypeBEQLDate
+	case TypeLEQWDate:
+		return TypeBEQWDate
+	case TypeLEFloat:
+		return TypeBEFloat
+	case TypeLEDouble:
+		return TypeBEDouble
+	}
+	return t
+}
+
 // isDateType returns true if the type is a date type.
 func isDateType(t FileType) bool {
 	switch t {
@@ -707,6 +1087,16 @@ func isDateType(t FileType) bool {
 	return false
 }
 
+// isFloatType reports whether the type is an IEEE-754 float or double.
+func isFloatType(t FileType) bool {
+	switch t {
+	case TypeFloat, TypeBEFloat, TypeLEFloat,
+		TypeDouble, TypeBEDouble, TypeLEDouble:
+		return true
+	}
+	return false
+}
+
 // varexpand expands variable expressions like ${x?true_value:false_value} in descriptions.
 // Currently supports only the 'x' variable, which checks if the file has execute permission.
 // This matches C file's varexpand() in softmagic.c.
@@ -763,19 +1153,104 @@ func varexpand(desc string, mode os.FileMode) string {
 	return out.String()
 }
 
-// formatDesc formats the description using the matched value.
-func (m *Matcher) formatDesc(desc string, val Value) string {
+// appendFormatDesc appends the description of entry, formatted with the
+// value it matched, to dst.
+func (s *matchState) appendFormatDesc(dst []byte, entry *MagicEntry, val Value) []byte {
+	desc := entry.Desc
 	if desc == "" {
-		return ""
+		return dst
 	}
 	// Expand variable expressions like ${x?true:false}
 	if strings.Contains(desc, "${") {
-		desc = varexpand(desc, m.fileMode)
+		desc = varexpand(desc, s.fileMode)
 	}
 	if !strings.Contains(desc, "%") {
-		return desc
+		return append(dst, desc...)
+	}
+	return appendPrintf(dst, desc, entry, val)
+}
+
+// renderString formats the description recorded in r.
+func (s *matchState) renderString(r *descRecord) string {
+	out := s.getDesc()
+	defer s.putDesc(out)
+	s.render(out, r.ops)
+	return out.String()
+}
+
+// render formats the description steps ops, appending them to out.
+func (s *matchState) render(out *descBuffer, ops []descOp) {
+	for i := 0; i < len(ops); i++ {
+		op := &ops[i]
+		switch op.kind {
+		case descTop:
+			out.b = s.appendFormatDesc(out.b, op.entry, displayValue(op.entry, op.val))
+		case descEntry:
+			desc := s.getDesc()
+			desc.b = s.appendFormatDesc(desc.b, op.entry, displayValue(op.entry, op.val))
+			appendDesc(out, desc.b)
+			s.putDesc(desc)
+		case descText:
+			appendDesc(out, op.text)
+		case descUse:
+			useResult := s.getDesc()
+			s.render(useResult, ops[i+1:i+1+op.n])
+			joinUse(out, useResult, op.group)
+			s.putDesc(useResult)
+			i += op.n
+		}
+	}
+}
+
+// joinUse appends to out the output of a named group called by use.
+func joinUse(out, useResult *descBuffer, group *MagicGroup) {
+	if useResult.Len() == 0 {
+		return
+	}
+	// Check if the named group's first continuation has \b prefix
+	// in its description, meaning the result should be appended without space
+	hasBackspace := false
+	for _, e := range group.Entries[1:] {
+		if e.Desc != "" {
+			hasBackspace = strings.HasPrefix(e.Desc, "\\b")
+			break
+		}
+	}
+	// Handle ": " prefix: replace entire previous output with specific identification.
+	// In OLE2/CDF magic rules, ": Type" means "this is a more specific identification
+	// that replaces the generic type". C's file handles this via a dedicated CDF parser.
+	if c := useResult.b[0]; useResult.hasPrefix(": ") {
+		out.Reset()
+		out.addBytes(useResult.b[2:])
+	} else if hasBackspace || c == ',' || c == '.' || c == ';' || c == ':' {
+		out.addBytes(useResult.b)
+	} else {
+		appendDesc(out, useResult.b)
+	}
+}
+
+// displayValue returns the value the description of entry prints: dates
+// and GUIDs print as text.
+func displayValue(entry *MagicEntry, val Value) Value {
+	if isDateType(entry.Type) {
+		return formatDateValue(val, entry)
+	}
+	if entry.Type == TypeGUID && val.IsString && len(val.Str) == 16 {
+		return Value{Str: []byte(formatGUID(val.Str)), IsString: true}
+	}
+	return val
+}
+
+// formatsEmpty reports whether the description desc formatted with val is
+// empty, without formatting desc unless it uses a variable.
+func (s *matchState) formatsEmpty(desc string, val Value) bool {
+	if i := strings.Index(desc, "${"); i >= 0 {
+		if !printfEmpty(desc[:i], val) {
+			return false
+		}
+		desc = varexpand(desc, s.fileMode)
 	}
-	return printfFormat(desc, val)
+	return printfEmpty(desc, val)
 }
 
 // formatDateValue converts a numeric timestamp to a date string for date types.
@@ -823,13 +1298,25 @@ func formatMSDOSTime(v uint16) Value {
 	return Value{Str: []byte(timeStr), IsString: true}
 }
 
-// printfFormat handles printf-style format strings.
-func printfFormat(format string, val Value) string {
-	var out strings.Builder
+// printfFormat handles printf-style format strings. val is the value
+// entry matched.
+func printfFormat(format string, entry *MagicEntry, val Value) string {
+	return string(appendPrintf(nil, format, entry, val))
+}
+
+// appendPrintf appends format, with its conversions applied to val, to
+// dst. Conversions without flags, width or precision skip fmt.
+func appendPrintf(dst []byte, format string, entry *MagicEntry, val Value) []byte {
+	// Numeric holds the raw bits of the type. Like file(1), %d and %s
+	// print those of a signed type sign-extended.
+	signed := 0
+	if !entry.Unsigned {
+		signed = intWidth(entry.Type)
+	}
 	i := 0
 	for i < len(format) {
 		if format[i] != '%' || i+1 >= len(format) {
-			out.WriteByte(format[i])
+			dst = append(dst, format[i])
 			i++
 			continue
 		}
@@ -856,32 +1343,117 @@ func printfFormat(format string, val Value) string {
 		verb := format[i]
 		i++
 
+		if i-start == 2 {
+			if d, ok := appendPlain(dst, verb, val, signed); ok {
+				dst = d
+				continue
+			}
+		}
 		goFmt := buildGoFmt(format[start:i], verb)
 
 		switch verb {
-		case 'd', 'i', 'u':
-			fmt.Fprintf(&out, goFmt, val.Numeric)
+		case 'd', 'i':
+			if signed > 0 {
+				dst = fmt.Appendf(dst, goFmt, int64(signExtend(val.Numeric, signed)))
+			} else {
+				dst = fmt.Appendf(dst, goFmt, val.Numeric)
+			}
+		case 'u':
+			dst = fmt.Appendf(dst, goFmt, val.Numeric)
 		case 'x', 'X', 'o':
 			// C behavior: %#x with value 0 suppresses the 0x prefix
 			if val.Numeric == 0 && strings.Contains(goFmt, "#") {
 				goFmt = strings.ReplaceAll(goFmt, "#", "")
 			}
-			fmt.Fprintf(&out, goFmt, val.Numeric)
+			dst = fmt.Appendf(dst, goFmt, val.Numeric)
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			dst = fmt.Appendf(dst, goFmt, val.Float)
 		case 'c':
-			out.WriteByte(byte(val.Numeric))
+			dst = append(dst, byte(val.Numeric))
 		case 's':
 			if val.IsString {
-				fmt.Fprintf(&out, goFmt, string(val.Str))
+				dst = fmt.Appendf(dst, goFmt, string(val.Str))
 			} else {
-				fmt.Fprintf(&out, "%d", val.Numeric)
+				dst = appendDecimal(dst, val.Numeric, signed)
 			}
 		case '%':
-			out.WriteByte('%')
+			dst = append(dst, '%')
 		default:
-			out.WriteString(format[start:i])
+			dst = append(dst, format[start:i]...)
 		}
 	}
-	return out.String()
+	return dst
+}
+
+// appendPlain appends val converted by the plain conversion %verb to dst,
+// treating integers as signed of that width if signed is not 0. It reports
+// false for the verbs it leaves to fmt.
+func appendPlain(dst []byte, verb byte, val Value, signed int) ([]byte, bool) {
+	switch verb {
+	case 'd', 'i':
+		return appendDecimal(dst, val.Numeric, signed), true
+	case 'u':
+		return strconv.AppendUint(dst, val.Numeric, 10), true
+	case 'x':
+		return strconv.AppendUint(dst, val.Numeric, 16), true
+	case 'o':
+		return strconv.AppendUint(dst, val.Numeric, 8), true
+	case 's':
+		if val.IsString {
+			return append(dst, val.Str...), true
+		}
+		return appendDecimal(dst, val.Numeric, signed), true
+	}
+	return dst, false
+}
+
+// appendDecimal appends v in decimal to dst, as a signed integer of width
+// bytes if width is not 0.
+func appendDecimal(dst []byte, v uint64, width int) []byte {
+	if width > 0 {
+		return strconv.AppendInt(dst, int64(signExtend(v, width)), 10)
+	}
+	return strconv.AppendUint(dst, v, 10)
+}
+
+// printfEmpty reports whether printfFormat(format, entry, val) is empty.
+// Only a %s of an empty string and an incomplete conversion at the end
+// print nothing.
+func printfEmpty(format string, val Value) bool {
+	i := 0
+	for i < len(format) {
+		if format[i] != '%' || i+1 >= len(format) {
+			return false
+		}
+		i++
+		for i < len(format) && (format[i] == '-' || format[i] == '+' || format[i] == ' ' || format[i] == '0' || format[i] == '#') {
+			i++
+		}
+		if i < len(format) && format[i] >= '1' && format[i] <= '9' {
+			return false // padded to a width
+		}
+		prec := -1
+		if i < len(format) && format[i] == '.' {
+			i++
+			prec = 0
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				prec = prec*10 + int(format[i]-'0')
+				i++
+			}
+		}
+		for i < len(format) && (format[i] == 'l' || format[i] == 'h' || format[i] == 'L') {
+			i++
+		}
+		if i >= len(format) {
+			break
+		}
+		verb := format[i]
+		i++
+		if verb != 's' || !val.IsString || len(val.Str) > 0 && prec != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func buildGoFmt(cFmt string, verb byte) string {
@@ -905,6 +1477,13 @@ func buildGoFmt(cFmt string, verb byte) string {
 		b.WriteByte('o')
 	case 's':
 		b.WriteByte('s')
+	case 'g', 'G':
+		// C prints 6 significant digits by default; Go prints as many
+		// as the value needs.
+		if !strings.Contains(cFmt, ".") {
+			b.WriteString(".6")
+		}
+		b.WriteByte(verb)
 	default:
 		b.WriteByte(verb)
 	}
@@ -988,11 +1567,21 @@ func decodeUTF16(buf []byte) []byte {
 }
 
 // matchTextMagic runs TEXTTEST magic rules against decoded text content.
-func (m *Matcher) matchTextMagic(decoded []byte) string {
-	bestResult := ""
+// The returned Result has an empty Desc when nothing matched.
+func (s *matchState) matchTextMagic(decoded []byte) Result {
+	best, out := s.getRecord(), s.getRecord()
+	defer func() { s.putRecord(best); s.putRecord(out) }()
 	bestScore := 0
+	var bestGroup *MagicGroup
+	var bestMeta ruleMeta
 
-	for _, group := range m.set.Groups {
+	filter := s.getFilter(decoded)
+	defer s.putFilter(filter)
+	for i := range s.set.Groups {
+		if s.canceled() {
+			break
+		}
+		group := &s.set.Groups[i]
 		top := group.Entries[0]
 		if top.Type == TypeName {
 			continue
@@ -1001,28 +1590,35 @@ func (m *Matcher) matchTextMagic(decoded []byte) string {
 		if top.StrFlags&StrFlagTextTest == 0 && !isAutoTextTest(top) {
 			continue
 		}
-		result, score := m.matchGroupScored(decoded, &group, 0)
-		if result != "" && score > bestScore {
-			bestResult = result
+		if !filter.may(i) {
+			continue
+		}
+		var meta ruleMeta
+		out.reset()
+		score := s.matchGroupScored(out, decoded, group, 0, &meta)
+		if out.printed && score > bestScore {
+			best, out = out, best
 			bestScore = score
+			bestGroup = group
+			bestMeta = meta
 		}
 	}
 
-	return bestResult
+	if bestGroup == nil {
+		return Result{}
+	}
+	return groupResult(s.renderString(best), bestGroup, &bestMeta, SourceText)
 }
 
-func appendDesc(out *strings.Builder, desc string) {
-	if desc == "" {
+func appendDesc[T string | []byte](out *descBuffer, desc T) {
+	if len(desc) == 0 {
 		return
 	}
 	// Handle \b at the start: suppress space before this output
-	if strings.HasPrefix(desc, "\\b") {
+	if len(desc) >= 2 && desc[0] == '\\' && desc[1] == 'b' {
 		desc = desc[2:]
-		out.WriteString(desc)
 	} else if out.Len() > 0 {
-		out.WriteByte(' ')
-		out.WriteString(desc)
-	} else {
-		out.WriteString(desc)
+		out.addByte(' ')
 	}
+	out.b = append(out.b, desc...)
 }
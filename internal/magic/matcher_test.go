@@ -1,7 +1,14 @@
 package magic
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -110,6 +117,145 @@ func TestMatch_ContinuationWithFormat(t *testing.T) {
 	}
 }
 
+func TestMatch_Float(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	FLT	floats
+>4	lefloat	>0.0001	positive
+>>4	lefloat	x	\b, %f
+>>4	lefloat	x	\b, %g
+>4	lefloat	<0	negative
+>8	bedouble	8.642135e+130	\b, marker
+>16	ledouble	x	\b, fps %.2f
+>16	ledouble	!0	\b, %e
+`))
+	m := NewMatcher(&MagicSet{Entries: entries})
+
+	buf := make([]byte, 24)
+	copy(buf, "FLT")
+	binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(0.1))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(8.642135e+130))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(29.97))
+	want := "floats positive, 0.100000, 0.1, marker, fps 29.97, 2.997000e+01"
+	if got := m.Match(buf); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+
+	binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(-2))
+	binary.LittleEndian.PutUint64(buf[16:], 0)
+	want = "floats negative, marker, fps 0.00"
+	if got := m.Match(buf); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+}
+
+func TestMatch_Signed(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	INT	ints
+>3	byte	x	\b, %d
+>3	byte	x	%u
+>3	byte	x	%x
+>3	ubyte	x	%d
+>4	beshort	<0	\b, negative %d
+>4	ubeshort	x	%u
+>6	lelong&0xff	x	\b, %d
+>10	bequad	x	\b, %lld
+>10	ubequad	x	%llu
+>3	byte	x	\b, %s
+>3	ubyte	x	%s
+`))
+	m := NewMatcher(&MagicSet{Entries: entries})
+
+	buf := []byte("INT\xff\xff\x9c\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe")
+	want := "ints, -1 255 ff 255, negative -100 65436, 255, -2 18446744073709551614, -1 255"
+	if got := m.Match(buf); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+}
+
+func TestMatch_Octal(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+257	string	ustar	tar
+>100	octal	x	\b, mode %o
+>124	octal	>1000	\b, size %d
+>108	octal	1750	\b, uid 1000
+>108	octal&07	0	\b, uid a multiple of 8
+>108	octal	<100	\b, system uid
+>100	octal	x
+>>&0	byte	0	\b, NUL-terminated
+`))
+	m := NewMatcher(&MagicSet{Entries: entries})
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: "hello.txt", Mode: 0644, Uid: 1000, Size: 1234, Format: tar.FormatUSTAR}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	tw.Write(make([]byte, hdr.Size))
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := "tar, mode 644, size 1234, uid 1000, uid a multiple of 8, NUL-terminated"
+	if got := m.Match(buf.Bytes()); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+}
+
+func TestMatch_ID3(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	ID3	ID3v2
+>6	beid3	x	\b, %d bytes
+>6	beid3	<0x80	\b, small
+>6	beid3&0x7f	x	\b, low %d
+>6	beid3	300	\b, exactly 300
+>10	leid3	0x4001	\b, le %#x
+`))
+	m := NewMatcher(&MagicSet{Entries: entries})
+
+	// 300 and 0x4001 as syncsafe integers, big- and little-endian.
+	buf := []byte("ID3\x04\x00\x00\x00\x00\x02\x2c\x01\x00\x01\x00")
+	want := "ID3v2, 300 bytes, low 44, exactly 300, le 0x4001"
+	if got := m.Match(buf); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+}
+
+func TestMatch_ID3Magdir(t *testing.T) {
+	m := NewMatcher(loadTestMagicSet(t))
+
+	// The audio rule finds the MPEG frame after the tag through (6.I+10).
+	buf := make([]byte, 1024)
+	copy(buf, "ID3\x04\x00\x40\x00\x00\x02\x2c")
+	copy(buf[310:], "\xff\xfb\x90\x64")
+	want := "Audio file with ID3 version 2.4.0, extended header, contains: MPEG ADTS, layer III, v1, 128 kbps, 44.1 kHz, JntStereo"
+	if got := m.Match(buf); got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+}
+
+func TestPrintfFormat_Float(t *testing.T) {
+	tests := []struct {
+		format string
+		v      float64
+		want   string
+	}{
+		{"%g", 0.1, "0.1"},
+		{"%g", 1234567, "1.23457e+06"},
+		{"%g", 0.00001, "1e-05"},
+		{"%.3g", 3.14159, "3.14"},
+		{"%f", 1.5, "1.500000"},
+		{"%.1f", 2.25, "2.2"},
+		{"%e", 1500, "1.500000e+03"},
+		{"%G", 1e-10, "1E-10"},
+		{"%lf", 0.5, "0.500000"},
+	}
+	for _, tt := range tests {
+		if got := printfFormat(tt.format, &MagicEntry{Type: TypeDouble}, Value{Float: tt.v}); got != tt.want {
+			t.Errorf("printfFormat(%q, %g) = %q, want %q", tt.format, tt.v, got, tt.want)
+		}
+	}
+}
+
 func TestVarexpand(t *testing.T) {
 	tests := []struct {
 		desc       string
@@ -146,3 +292,279 @@ func TestVarexpand(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchResult_SoftMagic(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	\xff\xd8\xff	JPEG image data
+!:mime	image/jpeg
+!:ext	jpeg/jpg/jpe/jfif
+!:apple	8BIMJPEG
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	result := m.MatchResult([]byte{0xff, 0xd8, 0xff, 0xe0, 0, 0x10})
+	if result.Desc != "JPEG image data" {
+		t.Errorf("Desc = %q, want %q", result.Desc, "JPEG image data")
+	}
+	if result.MimeType != "image/jpeg" {
+		t.Errorf("MimeType = %q, want %q", result.MimeType, "image/jpeg")
+	}
+	if strings.Join(result.Extensions, "/") != "jpeg/jpg/jpe/jfif" {
+		t.Errorf("Extensions = %v, want [jpeg jpg jpe jfif]", result.Extensions)
+	}
+	if result.Apple != "8BIMJPEG" {
+		t.Errorf("Apple = %q, want %q", result.Apple, "8BIMJPEG")
+	}
+	if result.Strength != set.Groups[0].Strength {
+		t.Errorf("Strength = %d, want %d", result.Strength, set.Groups[0].Strength)
+	}
+	if result.Source != SourceSoftMagic {
+		t.Errorf("Source = %v, want %v", result.Source, SourceSoftMagic)
+	}
+}
+
+func TestMatchResult_Source(t *testing.T) {
+	set := &MagicSet{NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	tests := []struct {
+		buf  []byte
+		want Source
+	}{
+		{[]byte(`{"key": "value"}`), SourceJSON},
+		{[]byte("plain text\n"), SourceText},
+		{[]byte{0x00, 0x01, 0x02, 0x03}, SourceData},
+	}
+	for _, tt := range tests {
+		if got := m.MatchResult(tt.buf).Source; got != tt.want {
+			t.Errorf("MatchResult(%q).Source = %v, want %v", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestMatchResult_MimeFromContinuation(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	RIFF	RIFF (little-endian) data
+>8	string	WAVE	\b, WAVE audio
+!:mime	audio/x-wav
+>8	string	AVI\040	\b, AVI
+!:mime	video/x-msvideo
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	result := m.MatchResult([]byte("RIFF\x24\x00\x00\x00WAVEfmt "))
+	if result.MimeType != "audio/x-wav" {
+		t.Errorf("MimeType = %q, want %q", result.MimeType, "audio/x-wav")
+	}
+	result = m.MatchResult([]byte("RIFF\x24\x00\x00\x00XXXXfmt "))
+	if result.MimeType != "application/octet-stream" {
+		t.Errorf("MimeType = %q, want %q", result.MimeType, "application/octet-stream")
+	}
+}
+
+func TestMatchResult_MimeVarexpand(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	\x7fELF	ELF ${x?pie executable:shared object}
+!:mime	application/x-${x?pie-executable:sharedlib}
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	buf := []byte("\x7fELF\x02\x01\x01")
+	if got := m.MatchResultWithMode(buf, 0755).MimeType; got != "application/x-pie-executable" {
+		t.Errorf("MimeType = %q, want %q", got, "application/x-pie-executable")
+	}
+	if got := m.MatchResultWithMode(buf, 0644).MimeType; got != "application/x-sharedlib" {
+		t.Errorf("MimeType = %q, want %q", got, "application/x-sharedlib")
+	}
+}
+
+func TestMatchResult_Extensions(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	RIFF	RIFF (little-endian) data
+!:ext	riff
+>8	string	WAVE	\b, WAVE audio
+!:ext	wav
+>>12	string	fmt\040	\b, with format
+>8	string	AVI\040	\b, AVI
+!:ext	avi
+>>12	use	avi-list
+
+0	name	avi-list
+>0	string	LIST	\b, list
+!:ext	avi/divx
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	tests := []struct {
+		buf  string
+		want string
+	}{
+		{"RIFF\x24\x00\x00\x00WAVEfmt ", "wav"},
+		{"RIFF\x24\x00\x00\x00AVI LIST", "avi/divx"},
+		{"RIFF\x24\x00\x00\x00AVI XXXX", "avi"},
+		{"RIFF\x24\x00\x00\x00XXXXfmt ", "riff"},
+	}
+	for _, tt := range tests {
+		result := m.MatchResult([]byte(tt.buf))
+		if got := strings.Join(result.Extensions, "/"); got != tt.want {
+			t.Errorf("MatchResult(%q).Extensions = %q, want %q", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestMatchResult_Apple(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	GIF8	GIF image data
+>4	string	9a	\b, version 89a
+!:apple	8BIMGIFf
+>4	string	7a	\b, version 87a
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	if got := m.MatchResult([]byte("GIF89a\x01\x00")).Apple; got != "8BIMGIFf" {
+		t.Errorf("Apple = %q, want %q", got, "8BIMGIFf")
+	}
+	if got := m.MatchResult([]byte("GIF87a\x01\x00")).Apple; got != "" {
+		t.Errorf("Apple = %q, want empty", got)
+	}
+}
+
+func TestMatchResult_BuiltinMime(t *testing.T) {
+	set := &MagicSet{NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+	tests := []struct {
+		buf  []byte
+		want string
+	}{
+		{[]byte(`{"key": "value"}`), "application/json"},
+		{[]byte("{\"a\": 1}\n{\"b\": 2}\n"), "application/x-ndjson"},
+		{[]byte("plain text\n"), "text/plain"},
+		{[]byte{0x00, 0x01, 0x02, 0x03}, "application/octet-stream"},
+		{[]byte{}, "application/x-empty"},
+	}
+	for _, tt := range tests {
+		if got := m.MatchResult(tt.buf).MimeType; got != tt.want {
+			t.Errorf("MatchResult(%q).MimeType = %q, want %q", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher_Concurrent(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	string	\x7fELF	ELF ${x?pie executable:shared object}
+>4	byte	2	\b, 64-bit
+0	string	ind	indirect
+>4	indirect	x	\b, contains
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+
+	elf := []byte("\x7fELF\x02\x01\x01")
+	ind := []byte("ind\x00\x7fELF\x02\x01")
+	tests := []struct {
+		buf  []byte
+		mode os.FileMode
+		want string
+	}{
+		{elf, 0755, "ELF pie executable, 64-bit"},
+		{elf, 0644, "ELF shared object, 64-bit"},
+		{ind, 0755, "indirect, contains ELF pie executable, 64-bit"},
+		{ind, 0644, "indirect, contains ELF shared object, 64-bit"},
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tt := tests[(g+i)%len(tests)]
+				if got := m.MatchWithMode(tt.buf, tt.mode); got != tt.want {
+					t.Errorf("MatchWithMode(%q, 0%o) = %q, want %q", tt.buf, tt.mode, got, tt.want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestMatchResultContext_Canceled(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	search/0x7fffffff	NEEDLE	needle found
+0	string	%PDF-	PDF document
+`))
+	set := &MagicSet{Entries: entries, NamedRules: make(map[string]int)}
+	m := NewMatcher(set)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.MatchResultContext(ctx, []byte("%PDF-1.4"), 0); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	result, err := m.MatchResultContext(context.Background(), []byte("%PDF-1.4"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Desc != "PDF document" {
+		t.Errorf("Desc = %q, want %q", result.Desc, "PDF document")
+	}
+}
+
+func TestMatchResult_SwappedUse(t *testing.T) {
+	m := NewMatcher(&MagicSet{Entries: mustParse(t, `
+0	name	header
+>0	beshort	0x0102	\b, 258
+>2	ubelong	x	\b, size %u
+>(2.L)	byte	x	\b, at %c
+>0	use	^order
+0	name	order
+>0	beshort	0x0201	\b, order
+0	string	BE	BE
+>2	use	header
+0	string	LE	LE
+>2	use	\^header
+`)})
+
+	// A "^" call reads the big- and little-endian tests and indirect
+	// offsets of the rule the other way round; a second one swaps back.
+	tests := []struct {
+		buf  string
+		want string
+	}{
+		{"BE\x01\x02\x00\x00\x00\x08x", "BE, 258, size 8, at x, order"},
+		{"LE\x02\x01\x08\x00\x00\x00x", "LE, 258, size 8, at x, order"},
+		{"LE\x01\x02\x00\x00\x00\x08x", "LE, size 134217728"},
+	}
+	for _, tt := range tests {
+		if got := m.MatchResult([]byte(tt.buf)).Desc; got != tt.want {
+			t.Errorf("MatchResult(%q).Desc = %q, want %q", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestMatchResult_UseCycle(t *testing.T) {
+	entries, _ := ParseMagicBytes("test", []byte(`
+0	name	ping
+>0	use	pong
+0	name	pong
+>0	use	ping
+0	string	CYCLE	cycle
+>0	use	ping
+0	string	WALK	walk
+>4	use	walk
+0	name	walk
+>0	byte	x	\b, %c
+>1	use	walk
+`))
+	m := NewMatcher(&MagicSet{Entries: entries})
+
+	const want = "ERROR: name use count (50) exceeded"
+	if got := m.MatchResult([]byte("CYCLE")).Desc; got != want {
+		t.Errorf("Desc = %q, want %q", got, want)
+	}
+	// Recursion that moves through the input ends with it.
+	if got, want := m.MatchResult([]byte("WALKabc")).Desc, "walk, a, b, c"; got != want {
+		t.Errorf("Desc = %q, want %q", got, want)
+	}
+}
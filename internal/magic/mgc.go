@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"strconv"
 )
 
 // .mgc compiled magic file format constants.
@@ -58,7 +59,18 @@ func ParseMgcFile(path string) (*MagicSet, error) {
 	if err != nil {
 		return nil, fmt.Errorf("reading mgc file: %w", err)
 	}
-	return ParseMgcBytes(data)
+	set, err := ParseMgcBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	// Compiled entries keep their source line but not their file.
+	for _, e := range set.Entries {
+		e.Filename = path
+	}
+	for i := range set.Diagnostics {
+		set.Diagnostics[i].File = path
+	}
+	return set, nil
 }
 
 // ParseMgcBytes parses compiled .mgc data from a byte slice.
@@ -226,6 +238,12 @@ func parseMgcEntry(raw []byte, hdr *mgcHeader) *MagicEntry {
 		entry.Value.Str = make([]byte, 16)
 		copy(entry.Value.Str, raw[offValue:offValue+16])
 		entry.Value.IsString = true
+	} else if typ == TypeOctal {
+		// Octal: file(1) stores the test value as its octal digits
+		vl := min(int(vallen), maxValueLen)
+		entry.Value.Str = make([]byte, vl)
+		copy(entry.Value.Str, raw[offValue:offValue+vl])
+		entry.Value.Numeric, _ = strconv.ParseUint(string(entry.Value.Str), 8, 64)
 	} else if typ == TypeName || typ == TypeUse {
 		// Name/Use: value is a string
 		vl := int(vallen)
@@ -381,9 +399,5 @@ func NewFromMgcFile(path string, opts Options) (*FileIdentifier, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &FileIdentifier{
-		set:     set,
-		matcher: NewMatcher(set),
-		options: opts,
-	}, nil
+	return newFileIdentifier(set, opts), nil
 }
@@ -156,6 +156,31 @@ func TestParseMgcNumericEntry(t *testing.T) {
 	}
 }
 
+func TestParseMgcOctalEntry(t *testing.T) {
+	const entrySize = 376
+
+	header := make([]byte, entrySize)
+	putLE32(header, 0, mgcMagicLE)
+	putLE32(header, 4, 18)
+	putLE32(header, 8, 1)
+
+	entry := make([]byte, entrySize)
+	entry[4] = '='
+	entry[5] = 3 // vallen
+	entry[6] = byte(TypeOctal)
+	putLE32(entry, 12, 100)
+	copy(entry[32:], "755") // the test is stored as its digits
+
+	set, err := ParseMgcBytes(append(header, entry...))
+	if err != nil {
+		t.Fatalf("ParseMgcBytes: %v", err)
+	}
+	e := set.Entries[0]
+	if e.Value.IsString || e.Value.Numeric != 0755 || string(e.Value.Str) != "755" {
+		t.Errorf("Value = %+v, want numeric 0755 with digits 755", e.Value)
+	}
+}
+
 func TestParseMgcWithContinuations(t *testing.T) {
 	const entrySize = 376
 
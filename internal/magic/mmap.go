@@ -0,0 +1,40 @@
+package magic
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime/debug"
+)
+
+// errMappingFault is returned when a memory-mapped file cannot be read,
+// typically because it was truncated while being identified.
+var errMappingFault = errors.New("fault reading memory-mapped file (truncated during identification?)")
+
+// identifyMapped identifies f, a regular file of the given size, through a
+// read-only memory mapping that serves as both the match buffer and the
+// random-access reader. mapped is false if f cannot be mapped, in which
+// case the caller should read it instead.
+func (fi *FileIdentifier) identifyMapped(ctx context.Context, f *os.File, size int64, mode os.FileMode) (result Result, mapped bool, err error) {
+	data, err := mmapFile(f, size)
+	if err != nil {
+		return Result{}, false, nil
+	}
+	defer func() { _ = munmapFile(data) }()
+
+	// Touching pages past the end of a file that shrank after mapping raises
+	// SIGBUS. SetPanicOnFault turns it into a recoverable panic on this
+	// goroutine.
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); !ok {
+				panic(r)
+			}
+			result, mapped, err = Result{}, true, errMappingFault
+		}
+	}()
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	result, err = fi.identifyContent(ctx, data[:min(size, int64(fi.matcher.limits.bytes))], randomAccess{r: newBytesReaderAt(data), size: size}, mode)
+	return result, true, err
+}
@@ -0,0 +1,21 @@
+package magic
+
+import (
+	"errors"
+	"math"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of f read-only.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	if size <= 0 || size > math.MaxInt {
+		return nil, errors.New("cannot map file of this size")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmapFile releases a mapping returned by mmapFile.
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,43 @@
+package magic
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIdentifyMapped_Truncated(t *testing.T) {
+	fi, err := NewFromFS(fstest.MapFS{"test": {Data: []byte(`
+0	string	HDR	header
+>-8	string	TRAILER	\b, with trailer
+`)}}, Options{Mmap: true})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+
+	const size = 1 << 20
+	path := sparseFile(t, size, map[int64][]byte{
+		0:                          []byte("HDR"),
+		-int64(len("TRAILER")) - 1: []byte("TRAILER"),
+	})
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	// Shrink the file after it was sized but before it is mapped, as a
+	// concurrent writer would: every page of the mapping is past EOF.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, mapped, err := fi.identifyMapped(context.Background(), f, size, 0)
+	if !mapped {
+		t.Fatal("identifyMapped did not map the file")
+	}
+	if !errors.Is(err, errMappingFault) {
+		t.Errorf("identifyMapped error = %v, want %v", err, errMappingFault)
+	}
+}
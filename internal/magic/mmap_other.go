@@ -0,0 +1,17 @@
+//go:build !linux
+
+package magic
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is only implemented on Linux; elsewhere files are always read.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
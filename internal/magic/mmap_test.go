@@ -0,0 +1,54 @@
+package magic
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIdentifyFile_Mmap(t *testing.T) {
+	rules := fstest.MapFS{"test": {Data: []byte(`
+0	string	HDR	header
+>(4.l)	string	DEEP	\b, indirect record
+>-8	string	TRAILER	\b, with trailer
+`)}}
+	plain, err := NewFromFS(rules, Options{})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+	mapped, err := NewFromFS(rules, Options{Mmap: true})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+
+	const size = 4 << 20
+	sparse := sparseFile(t, size, map[int64][]byte{
+		0:                          append([]byte("HDR\x00"), le32(3<<20)...),
+		3 << 20:                    []byte("DEEP"),
+		-int64(len("TRAILER")) - 1: []byte("TRAILER"),
+	})
+	empty, err := os.CreateTemp(t.TempDir(), "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = empty.Close()
+
+	for _, path := range []string{sparse, empty.Name(), t.TempDir(), os.DevNull} {
+		want, wantErr := plain.IdentifyFile(path)
+		got, err := mapped.IdentifyFile(path)
+		if (err != nil) != (wantErr != nil) {
+			t.Fatalf("IdentifyFile(%s) error = %v, want %v", path, err, wantErr)
+		}
+		if got != want {
+			t.Errorf("IdentifyFile(%s) with Mmap = %q, want %q", path, got, want)
+		}
+	}
+
+	got, err := mapped.IdentifyFile(sparse)
+	if err != nil {
+		t.Fatalf("IdentifyFile: %v", err)
+	}
+	if want := "header, indirect record, with trailer"; got != want {
+		t.Errorf("IdentifyFile = %q, want %q", got, want)
+	}
+}
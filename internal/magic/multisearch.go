@@ -0,0 +1,142 @@
+package magic
+
+import "slices"
+
+// multiSearch is an Aho-Corasick automaton that finds the first occurrence
+// of each of a set of patterns in a single pass. Matching folds ASCII case,
+// so the occurrences it reports are a superset of those of case-sensitive
+// searches for the same patterns.
+type multiSearch struct {
+	class  [256]uint16 // byte -> alphabet class; 0 for bytes in no pattern
+	nclass int
+	next   []int32   // next[state*nclass+class] is the DFA transition
+	out    [][]int32 // patterns ending at each state, including via suffixes
+	lens   []int     // pattern lengths
+}
+
+// newMultiSearch builds the automaton for patterns, none of which is empty.
+func newMultiSearch(patterns [][]byte) *multiSearch {
+	m := &multiSearch{nclass: 1, lens: make([]int, len(patterns))}
+	for _, p := range patterns {
+		for _, b := range p {
+			b = toLowerASCII(b)
+			if m.class[b] == 0 {
+				m.class[b] = uint16(m.nclass)
+				m.nclass++
+			}
+		}
+	}
+	for b := 'A'; b <= 'Z'; b++ {
+		m.class[b] = m.class[b+'a'-'A']
+	}
+
+	// Build the trie; -1 marks a missing edge.
+	newState := func() int32 {
+		for range m.nclass {
+			m.next = append(m.next, -1)
+		}
+		m.out = append(m.out, nil)
+		return int32(len(m.out) - 1)
+	}
+	newState()
+	for i, p := range patterns {
+		m.lens[i] = len(p)
+		state := int32(0)
+		for _, b := range p {
+			edge := int(state)*m.nclass + int(m.class[b])
+			if m.next[edge] < 0 {
+				child := newState()
+				m.next[edge] = child
+			}
+			state = m.next[edge]
+		}
+		m.out[state] = append(m.out[state], int32(i))
+	}
+
+	// Turn the trie into a DFA breadth-first, so that the failure state of
+	// every state is complete before it is used.
+	fail := make([]int32, len(m.out))
+	var queue []int32
+	for c := range m.nclass {
+		if t := m.next[c]; t < 0 {
+			m.next[c] = 0
+		} else {
+			queue = append(queue, t)
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		m.out[s] = append(m.out[s], m.out[fail[s]]...)
+		for c := range m.nclass {
+			edge := int(s)*m.nclass + c
+			fallback := m.next[int(fail[s])*m.nclass+c]
+			if t := m.next[edge]; t < 0 {
+				m.next[edge] = fallback
+			} else {
+				fail[t] = fallback
+				queue = append(queue, t)
+			}
+		}
+	}
+	return m
+}
+
+// searchScan is the progress of a multiSearch through one buffer. The scan
+// can be resumed, so it reads only as far as the searches asked about need.
+type searchScan struct {
+	state     int32
+	pos       int   // bytes consumed
+	first     []int // start of the first occurrence of each pattern, -1 if none yet
+	remaining int   // patterns not seen yet
+}
+
+func (m *multiSearch) newScan() *searchScan {
+	sc := new(searchScan)
+	m.startScan(sc)
+	return sc
+}
+
+// startScan resets sc to the start of a buffer, reusing its storage.
+func (m *multiSearch) startScan(sc *searchScan) {
+	sc.state, sc.pos, sc.remaining = 0, 0, len(m.lens)
+	sc.first = slices.Grow(sc.first[:0], len(m.lens))[:len(m.lens)]
+	for i := range sc.first {
+		sc.first[i] = -1
+	}
+}
+
+// advance feeds data[sc.pos:end] to the automaton, recording the first
+// occurrence of each pattern relative to data. It polls canceled every
+// searchChunk bytes and returns false if the scan was canceled.
+func (m *multiSearch) advance(sc *searchScan, data []byte, end int, canceled func() bool) bool {
+	state := sc.state
+	for i := sc.pos; i < end && sc.remaining > 0; i++ {
+		if (i-sc.pos)%searchChunk == 0 && canceled != nil && canceled() {
+			return false
+		}
+		state = m.next[int(state)*m.nclass+int(m.class[data[i]])]
+		for _, p := range m.out[state] {
+			if sc.first[p] < 0 {
+				sc.first[p] = i + 1 - m.lens[p]
+				sc.remaining--
+			}
+		}
+	}
+	sc.state, sc.pos = state, max(sc.pos, end)
+	return true
+}
+
+func toLowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+func toUpperASCII(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - ('a' - 'A')
+	}
+	return b
+}
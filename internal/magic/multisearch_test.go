@@ -0,0 +1,50 @@
+package magic
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMultiSearch(t *testing.T) {
+	patterns := [][]byte{
+		[]byte("he"), []byte("she"), []byte("his"), []byte("hers"),
+		[]byte("<HTML"), []byte("\x00\x01"), []byte("abcabd"),
+	}
+	m := newMultiSearch(patterns)
+
+	tests := []string{
+		"",
+		"ushers",
+		"this is his <html> page",
+		"abcabcabd \x00\x01",
+		"no match here",
+	}
+	for _, data := range tests {
+		sc := m.newScan()
+		if !m.advance(sc, []byte(data), len(data), nil) {
+			t.Fatalf("advance(%q) was canceled", data)
+		}
+		for i, p := range patterns {
+			want := bytesIndexCI([]byte(data), p)
+			if sc.first[i] != want {
+				t.Errorf("first occurrence of %q in %q = %d, want %d", p, data, sc.first[i], want)
+			}
+		}
+	}
+}
+
+func TestMultiSearch_Resume(t *testing.T) {
+	m := newMultiSearch([][]byte{[]byte("needle"), []byte("pin")})
+	data := []byte("....nee|dle....needle..pin")
+	sc := m.newScan()
+	for end := 0; end <= len(data); end += 3 {
+		m.advance(sc, data, end, nil)
+	}
+	m.advance(sc, data, len(data), nil)
+	if want := bytes.Index(data, []byte("needle")); sc.first[0] != want {
+		t.Errorf("first needle = %d, want %d", sc.first[0], want)
+	}
+	if want := bytes.Index(data, []byte("pin")); sc.first[1] != want {
+		t.Errorf("first pin = %d, want %d", sc.first[1], want)
+	}
+}
@@ -3,9 +3,12 @@ package magic
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -77,7 +80,7 @@ var typeNames = map[string]FileType{
 // isStringTypeName returns true if the type name refers to a string-like type.
 func isStringTypeName(name string) bool {
 	switch name {
-	case "string", "pstring", "bestring16", "lestring16", "search", "regex", "octal":
+	case "string", "pstring", "bestring16", "lestring16", "search", "regex":
 		return true
 	}
 	return false
@@ -87,7 +90,7 @@ func isStringTypeName(name string) bool {
 func isStringType(t FileType) bool {
 	switch t {
 	case TypeString, TypePString, TypeBEString16, TypeLEString16,
-		TypeSearch, TypeRegex, TypeOctal:
+		TypeSearch, TypeRegex, TypeDER:
 		return true
 	}
 	return false
@@ -118,11 +121,7 @@ func ParseMagicDir(dir string) (*MagicSet, error) {
 		if err != nil {
 			continue
 		}
-		entries, err := ParseMagicBytes(de.Name(), data)
-		if err != nil {
-			continue
-		}
-		set.Entries = append(set.Entries, entries...)
+		set.addMagic(de.Name(), data)
 	}
 
 	// Build groups from flat entries
@@ -183,12 +182,172 @@ func (set *MagicSet) buildGroups() {
 			set.NamedRules[string(g.Entries[0].Value.Str)] = i
 		}
 	}
+	set.index = buildGroupIndex(set.Groups)
+	set.Diagnostics = append(set.Diagnostics, set.compileRegexes()...)
+	set.Diagnostics = append(set.Diagnostics, set.checkUses()...)
+}
+
+// useName returns the name of the named rule a use entry calls, and whether
+// the call swaps the byte order of the rule's tests, as "use ^name" does.
+func useName(entry *MagicEntry) (name []byte, swap bool) {
+	name = entry.Value.Str
+	if len(name) > 0 && name[0] == '^' {
+		return name[1:], true
+	}
+	return name, false
+}
+
+// lookupUse returns the index of the group of the named rule the use entry
+// calls, whether the call swaps byte order, and whether the name is defined.
+// The matcher and checkUses both resolve calls through it.
+func (set *MagicSet) lookupUse(entry *MagicEntry) (group int, swap, ok bool) {
+	name, swap := useName(entry)
+	group, ok = set.NamedRules[string(name)]
+	return group, swap, ok
+}
+
+// checkUses returns diagnostics for the use entries that call an undefined
+// name, and for those that close a cycle of named rules calling each other
+// at the offset they were called at, as "0" and a first-level "&0" do.
+// Such a cycle, once entered, repeats the same tests until the name limit
+// stops it. Recursion that moves to another offset, as in rules walking a
+// chain of records, is not reported.
+func (set *MagicSet) checkUses() []Diagnostic {
+	var diags []Diagnostic
+	report := func(e *MagicEntry, format string, args ...any) {
+		diags = append(diags, Diagnostic{File: e.Filename, Line: e.LineNo, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make([]int, len(set.Groups))
+	var path []string
+	var visit func(g int)
+	visit = func(g int) {
+		name := string(set.Groups[g].Entries[0].Value.Str)
+		state[g] = onPath
+		path = append(path, name)
+		for _, e := range set.Groups[g].Entries[1:] {
+			if e.Type != TypeUse || !stationaryUse(e) {
+				continue
+			}
+			next, _, ok := set.lookupUse(e)
+			if !ok {
+				continue // reported below
+			}
+			switch state[next] {
+			case onPath:
+				name, _ := useName(e)
+				callee := string(name)
+				cycle := path[slices.Index(path, callee):]
+				report(e, "use of %q forms a cycle: %s -> %s", callee, strings.Join(cycle, " -> "), callee)
+			case unvisited:
+				visit(next)
+			}
+		}
+		path = path[:len(path)-1]
+		state[g] = done
+	}
+
+	// Start from the names in the order they are defined, so that a cycle
+	// is reported at the use that closes it in file order.
+	for _, e := range set.Entries {
+		if e.Type != TypeName {
+			continue
+		}
+		if g, ok := set.NamedRules[string(e.Value.Str)]; ok && state[g] == unvisited {
+			visit(g)
+		}
+	}
+	for _, e := range set.Entries {
+		if e.Type != TypeUse {
+			continue
+		}
+		if _, _, ok := set.lookupUse(e); !ok {
+			name, _ := useName(e)
+			report(e, "use of undefined name %q", name)
+		}
+	}
+	return diags
+}
+
+// stationaryUse reports whether the use entry e calls its named rule at
+// the offset its own group was called at. A first-level "&" offset is
+// relative to that offset; deeper ones follow a parent's match.
+func stationaryUse(e *MagicEntry) bool {
+	if e.Offset != 0 || e.Flag&FlagIndir != 0 {
+		return false
+	}
+	return e.Flag&FlagOffAdd == 0 || e.ContLevel == 1
+}
+
+// compileRegexes compiles the pattern of every regex entry and returns
+// diagnostics for the patterns that do not compile. Those entries never match.
+func (set *MagicSet) compileRegexes() []Diagnostic {
+	var diags []Diagnostic
+	for _, e := range set.Entries {
+		if e.Type != TypeRegex {
+			continue
+		}
+		re, err := regexp.Compile(regexPattern(e))
+		if err != nil {
+			diags = append(diags, Diagnostic{
+				File: e.Filename,
+				Line: e.LineNo,
+				Msg:  fmt.Sprintf("cannot compile regex: %v", err),
+			})
+			continue
+		}
+		e.re = re
+	}
+	return diags
+}
+
+// regexPattern returns the Go syntax of a regex entry's pattern.
+func regexPattern(entry *MagicEntry) string {
+	// Strip leading = if present
+	pattern := strings.TrimPrefix(string(entry.Value.Str), "=")
+	// Enable multiline mode (like C's REG_NEWLINE) so ^ matches at line boundaries
+	if strings.Contains(pattern, "^") {
+		pattern = "(?m)" + pattern
+	}
+	return pattern
 }
 
 // ParseMagicBytes parses a magic file from its raw bytes, returning all entries.
+// Lines that cannot be parsed are skipped; the loaders that build a
+// MagicSet, such as ParseMagicDir, also report warnings for them in its
+// Diagnostics.
 func ParseMagicBytes(name string, data []byte) ([]*MagicEntry, error) {
+	entries, _ := parseMagic(name, data)
+	return entries, nil
+}
+
+// addMagic adds the entries of the magic file data to set, and diagnostics
+// for the lines skipped with a warning.
+func (set *MagicSet) addMagic(name string, data []byte) {
+	entries, diags := parseMagic(name, data)
+	set.Entries = append(set.Entries, entries...)
+	set.Diagnostics = append(set.Diagnostics, diags...)
+}
+
+// lineWarning is the error of a line that is skipped with a warning, as
+// file(1) does. Other lines that cannot be parsed are skipped silently.
+type lineWarning struct {
+	msg string
+}
+
+func (w *lineWarning) Error() string { return w.msg }
+
+// parseMagic parses a magic file from its raw bytes, returning its entries
+// and the warnings for the lines it skipped.
+func parseMagic(name string, data []byte) ([]*MagicEntry, []Diagnostic) {
 	lines := strings.Split(string(data), "\n")
 	var entries []*MagicEntry
+	var diags []Diagnostic
 	for i, line := range lines {
 		lineNo := i + 1
 		// Skip empty lines and comments
@@ -207,11 +366,16 @@ func ParseMagicBytes(name string, data []byte) ([]*MagicEntry, error) {
 		entry, err := parseLine(line, lineNo)
 		if err != nil {
 			// Skip unparseable lines rather than failing
+			var w *lineWarning
+			if errors.As(err, &w) {
+				diags = append(diags, Diagnostic{File: name, Line: lineNo, Msg: w.msg})
+			}
 			continue
 		}
+		entry.Filename = name
 		entries = append(entries, entry)
 	}
-	return entries, nil
+	return entries, diags
 }
 
 // parseMetadata applies a !:directive to the given entry.
@@ -416,7 +580,9 @@ func parseLine(line string, lineNo int) (*MagicEntry, error) {
 
 	// 5. Parse test value and relation
 	if len(fields) >= 3 {
-		parseTestValue(entry, fields[2])
+		if err := parseTestValue(entry, fields[2]); err != nil {
+			return nil, err
+		}
 	}
 
 	// 6. Parse description
@@ -685,17 +851,23 @@ func isIndirOp(c byte) bool {
 
 // parseTestValue parses the test field into relation + value.
 // For numeric types, also parses masks: &0xFF00 before the test value.
-func parseTestValue(entry *MagicEntry, test string) {
+// It returns a *lineWarning if the line must be skipped.
+func parseTestValue(entry *MagicEntry, test string) error {
 	if test == "x" {
 		entry.Relation = 'x'
-		return
+		return nil
 	}
 
 	if entry.Type == TypeName || entry.Type == TypeUse {
-		entry.Value.Str = []byte(test)
+		// A name ends at whitespace; a leading '^' may be escaped.
+		name := strings.TrimRight(test, " ")
+		if strings.HasPrefix(name, `\^`) {
+			name = name[1:]
+		}
+		entry.Value.Str = []byte(name)
 		entry.Value.IsString = true
 		// Desc is set from the description field (fields[3:]) in the caller, not from test.
-		return
+		return nil
 	}
 
 	// Check for relation prefix
@@ -715,7 +887,7 @@ func parseTestValue(entry *MagicEntry, test string) {
 			entry.Value.Str = guid
 			entry.Value.IsString = true
 		}
-		return
+		return nil
 	}
 
 	if isStringType(entry.Type) {
@@ -728,22 +900,45 @@ func parseTestValue(entry *MagicEntry, test string) {
 		if descTail != "" && entry.Desc == "" {
 			entry.Desc = descTail
 		}
+	} else if isFloatType(entry.Type) {
+		numStr, descTail, _ := strings.Cut(test, " ")
+		f, _ := strconv.ParseFloat(numStr, 64)
+		if typeSize(entry.Type) == 4 {
+			// Compare as file(1) does, at the precision of the type.
+			f = float64(float32(f))
+		}
+		entry.Value.Float = f
+		if descTail = strings.TrimLeft(descTail, " \t"); descTail != "" && entry.Desc == "" {
+			entry.Desc = descTail
+		}
 	} else {
 		numStr, descTail := extractNumericTest(test)
-		n, err := strconv.ParseUint(numStr, 0, 64)
-		if err != nil {
-			sn, serr := strconv.ParseInt(numStr, 0, 64)
-			if serr == nil {
-				n = uint64(sn)
+		if entry.Type == TypeOctal {
+			// file(1) keeps the test of an octal field as its octal
+			// digits, whose count sets the strength of the entry.
+			n, err := strconv.ParseUint(numStr, 8, 64)
+			if err != nil {
+				return &lineWarning{fmt.Sprintf("bad octal value %q", numStr)}
+			}
+			entry.Value.Numeric = n
+			entry.Value.Str = []byte(numStr)
+		} else {
+			n, err := strconv.ParseUint(numStr, 0, 64)
+			if err != nil {
+				sn, serr := strconv.ParseInt(numStr, 0, 64)
+				if serr == nil {
+					n = uint64(sn)
+				}
 			}
+			entry.Value.Numeric = n
 		}
-		entry.Value.Numeric = n
 		// If the test field contained the description (single-space-separated),
 		// use it as the description if none was set yet.
 		if descTail != "" && entry.Desc == "" {
 			entry.Desc = descTail
 		}
 	}
+	return nil
 }
 
 // parseGUID parses a GUID string "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX" into 16 bytes.
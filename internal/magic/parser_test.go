@@ -3,7 +3,10 @@ package magic
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestParseLine_SimpleString(t *testing.T) {
@@ -91,6 +94,68 @@ func TestParseLine_UnsignedType(t *testing.T) {
 	}
 }
 
+func TestParseLine_Octal(t *testing.T) {
+	tests := []struct {
+		line     string
+		wantRel  byte
+		wantNum  uint64
+		wantMask uint64
+	}{
+		{">100\toctal\t755", '=', 0755, 0},
+		{">100\toctal\t0755", '=', 0755, 0},
+		{">124\toctal\t>1000", '>', 01000, 0},
+		{">100\toctal&0777\t644", '=', 0644, 0777},
+	}
+	for _, tt := range tests {
+		entry, err := parseLine(tt.line, 1)
+		if err != nil {
+			t.Fatalf("parseLine(%q): %v", tt.line, err)
+		}
+		if entry.Type != TypeOctal || entry.Value.IsString {
+			t.Errorf("parseLine(%q): Type = %d, IsString = %v, want numeric TypeOctal", tt.line, entry.Type, entry.Value.IsString)
+		}
+		if entry.Relation != tt.wantRel || entry.Value.Numeric != tt.wantNum || entry.NumMask != tt.wantMask {
+			t.Errorf("parseLine(%q) = %c %#o &%#o, want %c %#o &%#o", tt.line,
+				entry.Relation, entry.Value.Numeric, entry.NumMask, tt.wantRel, tt.wantNum, tt.wantMask)
+		}
+	}
+}
+
+func TestNewFromFS_BadOctal(t *testing.T) {
+	fi, err := NewFromFS(fstest.MapFS{"test": {Data: []byte(`
+0	string	TAR	tar
+>100	octal	8	\b, eight
+>100	octal	>0x10	\b, hex
+>100	octal	644	\b, mode 644
+`)}}, Options{})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+	if n := len(fi.set.Entries); n != 2 {
+		t.Errorf("NewFromFS kept %d entries, want 2", n)
+	}
+	want := []string{
+		`test, 3: Warning: bad octal value "8"`,
+		`test, 4: Warning: bad octal value "0x10"`,
+	}
+	var got []string
+	for _, d := range fi.Diagnostics() {
+		got = append(got, d.String())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Diagnostics = %q, want %q", got, want)
+	}
+}
+
+func TestCalcStrength_Octal(t *testing.T) {
+	// Like file(1), the digits of the test count as written.
+	padded := mustParse(t, "0\toctal\t0000644\n")[0]
+	short := mustParse(t, "0\toctal\t644\n")[0]
+	if got, want := calcStrength(padded)-calcStrength(short), 4*strengthMULT; got != want {
+		t.Errorf("strength of 0000644 - strength of 644 = %d, want %d", got, want)
+	}
+}
+
 func TestParseLine_DeepContinuation(t *testing.T) {
 	// >>>10 leshort 0x014c Intel 80386
 	entry, err := parseLine(">>>10\tleshort\t0x014c\tIntel 80386", 5)
@@ -188,3 +253,100 @@ func TestParseMagicDir_HasNamedRules(t *testing.T) {
 	}
 	t.Logf("Found %d named rules", len(set.NamedRules))
 }
+
+func TestBuildGroups_CompilesRegexes(t *testing.T) {
+	entries, err := ParseMagicBytes("test", []byte(`
+0	regex	^#include	C source
+0	regex	(unclosed	broken
+`))
+	if err != nil {
+		t.Fatalf("ParseMagicBytes failed: %v", err)
+	}
+	set := &MagicSet{Entries: entries}
+	set.buildGroups()
+
+	if entries[0].re == nil {
+		t.Errorf("regex %q was not compiled", entries[0].Value.Str)
+	}
+	if entries[1].re != nil {
+		t.Errorf("invalid regex %q was compiled", entries[1].Value.Str)
+	}
+	if len(set.Diagnostics) != 1 {
+		t.Fatalf("Diagnostics = %v, want one entry", set.Diagnostics)
+	}
+	d := set.Diagnostics[0]
+	if d.File != "test" || d.Line != 3 {
+		t.Errorf("diagnostic at %s:%d, want test:3", d.File, d.Line)
+	}
+	if want := "test, 3: Warning: cannot compile regex: "; !strings.HasPrefix(d.String(), want) {
+		t.Errorf("String() = %q, want prefix %q", d.String(), want)
+	}
+
+	m := NewMatcher(set)
+	if got, want := m.Match([]byte("/* x */\n#include <stdio.h>\n")), "C source, ASCII text"; got != want {
+		t.Errorf("Match = %q, want %q", got, want)
+	}
+}
+
+func TestParseLine_UseName(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+		swap bool
+	}{
+		{">0\tuse\tpart", "part", false},
+		{">0\tuse\tpart ", "part", false},
+		{">0\tuse\t^part", "part", true},
+		{">0\tuse\t\\^part", "part", true},
+		{">0\tuse\t\tpart\t\\b, desc", "part", false},
+		{"0\tname\tpart ", "part", false},
+	}
+	for _, tt := range tests {
+		entry, err := parseLine(strings.TrimLeft(tt.line, ">"), 1)
+		if err != nil {
+			t.Fatalf("parseLine(%q): %v", tt.line, err)
+		}
+		if got, swap := useName(entry); string(got) != tt.want || swap != tt.swap {
+			t.Errorf("parseLine(%q) name = %q, %v, want %q, %v", tt.line, got, swap, tt.want, tt.swap)
+		}
+	}
+}
+
+func TestBuildGroups_ChecksUses(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, `
+0	name	self
+>0	use	self
+0	name	rel
+>&0	use	rel
+0	name	ping
+>0	byte	1
+>>0	use	pong
+0	name	pong
+>0	use	ping
+0	name	walk
+>0	byte	!0
+>>&1	use	walk
+>>&0	use	walk
+>4	use	^walk
+0	string	TOP	top
+>0	use	missing
+>0	use	\^walk
+>0	use	^missing
+`)}
+	set.buildGroups()
+
+	want := []string{
+		`test, 3: Warning: use of "self" forms a cycle: self -> self`,
+		`test, 5: Warning: use of "rel" forms a cycle: rel -> rel`,
+		`test, 10: Warning: use of "ping" forms a cycle: ping -> pong -> ping`,
+		`test, 17: Warning: use of undefined name "missing"`,
+		`test, 19: Warning: use of undefined name "missing"`,
+	}
+	var got []string
+	for _, d := range set.Diagnostics {
+		got = append(got, d.String())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Diagnostics = %q, want %q", got, want)
+	}
+}
@@ -122,13 +122,16 @@ type elfInfo struct {
 	hasGoBuildID bool
 	stripped     bool
 	hasDebug     bool
-	isPIE        bool // for varexpand ${x?...}
+	isPIE        bool   // for varexpand ${x?...}
+	notesLeft    int    // notes that may still be examined (elf_notes limit)
+	tooMany      string // set when a header count exceeds its limit
 }
 
 // tryELF checks if buf is an ELF file and extracts detailed information.
 // buf is the initial file buffer (for magic identification check).
 // If r is non-nil, it's used for reading data at arbitrary offsets (for large files).
-func tryELF(buf []byte, r io.ReaderAt, fileSize int64) *elfInfo {
+// lim bounds the headers and notes examined, as in file(1).
+func tryELF(buf []byte, r io.ReaderAt, fileSize int64, lim limits) *elfInfo {
 	if len(buf) < eiNIDENT {
 		return nil
 	}
@@ -195,11 +198,21 @@ func tryELF(buf []byte, r io.ReaderAt, fileSize int64) *elfInfo {
 		shStrNdx = bo.Uint16(buf[50:])
 	}
 
-	info := &elfInfo{stripped: true}
+	info := &elfInfo{stripped: true, notesLeft: lim.elfNotes}
 
 	switch eType {
 	case etEXEC, etDYN:
+		// Like file(1), report a header count over its limit instead of
+		// examining the headers.
+		if int(phNum) > lim.elfPhnum {
+			info.tooMany = fmt.Sprintf("too many program (%d)", phNum)
+			return info
+		}
 		processPhdr(er, bo, is64, phOff, phEntSize, phNum, shNum > 0, info)
+		if int(shNum) > lim.elfShnum {
+			info.tooMany = fmt.Sprintf("too many section (%d)", shNum)
+			return info
+		}
 		processSections(er, bo, is64, shOff, shEntSize, shNum, shStrNdx, info)
 	default:
 		return nil // Only handle executables and shared objects
@@ -418,6 +431,10 @@ func processSections(er *elfReader, bo binary.ByteOrder, is64 bool, shOff uint64
 func processNotes(data []byte, bo binary.ByteOrder, info *elfInfo) {
 	offset := 0
 	for offset+elfNhdrSize <= len(data) {
+		if info.notesLeft <= 0 {
+			break
+		}
+		info.notesLeft--
 		namesz := bo.Uint32(data[offset:])
 		descsz := bo.Uint32(data[offset+4:])
 		ntype := bo.Uint32(data[offset+8:])
@@ -576,6 +593,11 @@ func formatELFInfo(info *elfInfo) string {
 	}
 	// Notes are already in the order they were found in the ELF file
 	parts = append(parts, info.notes...)
+	if info.tooMany != "" {
+		// The section headers, which tell whether the file is stripped,
+		// were not examined.
+		return strings.Join(append(parts, info.tooMany), ", ")
+	}
 
 	if info.hasDebug {
 		if info.stripped {
@@ -7,14 +7,14 @@ import (
 
 func TestTryELF_NotELF(t *testing.T) {
 	buf := []byte("not an ELF file at all")
-	if info := tryELF(buf, nil, 0); info != nil {
+	if info := tryELF(buf, nil, 0, defaultLimits); info != nil {
 		t.Errorf("expected nil for non-ELF, got %+v", info)
 	}
 }
 
 func TestTryELF_TooShort(t *testing.T) {
 	buf := []byte{0x7f, 'E', 'L'}
-	if info := tryELF(buf, nil, 0); info != nil {
+	if info := tryELF(buf, nil, 0, defaultLimits); info != nil {
 		t.Errorf("expected nil for short buffer, got %+v", info)
 	}
 }
@@ -224,7 +224,7 @@ func TestTryELF_DynamicallyLinked(t *testing.T) {
 		}),
 		withInterp("/lib64/ld-linux-x86-64.so.2"),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -242,7 +242,7 @@ func TestTryELF_DynamicallyLinked(t *testing.T) {
 func TestTryELF_StaticallyLinked(t *testing.T) {
 	// No PT_DYNAMIC → statically linked
 	buf := buildELF64(etEXEC)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -259,7 +259,7 @@ func TestTryELF_StaticPIE(t *testing.T) {
 			{dtNULL, 0},
 		}),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -283,7 +283,7 @@ func TestTryELF_GNUVersion(t *testing.T) {
 		}),
 		withNoteSection("GNU", ntGNUVersion, desc),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -301,7 +301,7 @@ func TestTryELF_BuildID(t *testing.T) {
 		withDynamic([][2]uint64{{dtNEEDED, 1}, {dtNULL, 0}}),
 		withNoteSection("GNU", ntGNUBuildID, desc),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -319,11 +319,47 @@ func TestTryELF_BuildID(t *testing.T) {
 	}
 }
 
+func TestTryELF_Limits(t *testing.T) {
+	bo := binary.LittleEndian
+	version := make([]byte, 16)
+	bo.PutUint32(version[0:], gnuOSLinux)
+	bo.PutUint32(version[4:], 3)
+	bo.PutUint32(version[8:], 2)
+	buf := buildELF64(etDYN,
+		withInterp("/lib/ld.so"),
+		withDynamic([][2]uint64{{dtNEEDED, 1}, {dtNULL, 0}}),
+		withNoteSection("GNU", ntGNUVersion, version),
+		withNoteSection("GNU", ntGNUBuildID, make([]byte, 20)),
+	)
+
+	lim := defaultLimits
+	lim.elfPhnum = 1
+	if got := formatELFInfo(tryELF(buf, nil, 0, lim)); got != "too many program (2)" {
+		t.Errorf("elf_phnum 1: formatELFInfo = %q, want %q", got, "too many program (2)")
+	}
+
+	lim = defaultLimits
+	lim.elfShnum = 1
+	got := formatELFInfo(tryELF(buf, nil, 0, lim))
+	if want := "dynamically linked, interpreter /lib/ld.so, too many section ("; !startsWith(got, want) {
+		t.Errorf("elf_shnum 1: formatELFInfo = %q, want prefix %q", got, want)
+	}
+
+	lim = defaultLimits
+	lim.elfNotes = 1
+	if info := tryELF(buf, nil, 0, lim); len(info.notes) != 1 {
+		t.Errorf("elf_notes 1: notes = %v, want one note", info.notes)
+	}
+	if info := tryELF(buf, nil, 0, defaultLimits); len(info.notes) != 2 {
+		t.Errorf("default limits: notes = %v, want two notes", info.notes)
+	}
+}
+
 func TestTryELF_Stripped(t *testing.T) {
 	buf := buildELF64(etDYN,
 		withDynamic([][2]uint64{{dtNEEDED, 1}, {dtNULL, 0}}),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -337,7 +373,7 @@ func TestTryELF_NotStripped(t *testing.T) {
 		withDynamic([][2]uint64{{dtNEEDED, 1}, {dtNULL, 0}}),
 		withSymtab(),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
@@ -351,7 +387,7 @@ func TestTryELF_DebugInfo(t *testing.T) {
 		withDynamic([][2]uint64{{dtNEEDED, 1}, {dtNULL, 0}}),
 		withDebugInfo(),
 	)
-	info := tryELF(buf, nil, 0)
+	info := tryELF(buf, nil, 0, defaultLimits)
 	if info == nil {
 		t.Fatal("expected ELF info, got nil")
 	}
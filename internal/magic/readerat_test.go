@@ -0,0 +1,233 @@
+package magic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// sparseFile creates a sparse file of the given size with data written at
+// the given offsets; negative offsets are measured from the end.
+func sparseFile(t *testing.T, size int64, writes map[int64][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if err := f.Truncate(size); err != nil {
+		t.Skipf("cannot create a %d-byte sparse file: %v", size, err)
+	}
+	for off, data := range writes {
+		if off < 0 {
+			off += size
+		}
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+func TestIdentifyFile_BeyondReadWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates multi-gigabyte sparse files")
+	}
+	fi, err := NewFromFS(fstest.MapFS{"test": {Data: []byte(`
+0	string	HDR	header
+>4	lelong	x	\b, body at %#x
+>(4.l)	string	DEEP	\b, indirect record
+>0x40000000	search/4096	NEEDLE	\b, search hit
+>0x50000000	regex	Version\ [0-9]+	\b, %s
+>0x60000000	indirect	x	\b, contains
+>-8	string	TRAILER	\b, with trailer
+
+0	string	NEST	nested magic
+`)}}, Options{})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+
+	const size = 3 << 30
+	path := sparseFile(t, size, map[int64][]byte{
+		0:                          append([]byte("HDR\x00"), le32(0x80000000)...),
+		0x80000000:                 []byte("DEEP"),
+		0x40000000 + 1000:          []byte("NEEDLE"),
+		0x50000000:                 []byte("Version 42\n"),
+		0x60000000:                 []byte("NEST"),
+		-int64(len("TRAILER")) - 1: []byte("TRAILER"),
+	})
+
+	got, err := fi.IdentifyFile(path)
+	if err != nil {
+		t.Fatalf("IdentifyFile: %v", err)
+	}
+	want := "header, body at 0x80000000, indirect record, search hit, Version 42, contains nested magic, with trailer"
+	if got != want {
+		t.Errorf("IdentifyFile = %q\nwant %q", got, want)
+	}
+
+	// IdentifyReader has no random access and sees only the leading window.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	got, err = fi.IdentifyReader(f)
+	if err != nil {
+		t.Fatalf("IdentifyReader: %v", err)
+	}
+	if want := "header, body at 0x80000000"; got != want {
+		t.Errorf("IdentifyReader = %q, want %q", got, want)
+	}
+}
+
+func TestIdentifyFile_TrailerMagic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates multi-gigabyte sparse files")
+	}
+	fi, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// LevelDB tables end with an 8-byte magic number (Magdir/crypto: -8 lequad).
+	path := sparseFile(t, 5<<30, map[int64][]byte{
+		-8: binary.LittleEndian.AppendUint64(nil, 0xdb4775248b80fb57),
+	})
+	got, err := fi.IdentifyFile(path)
+	if err != nil {
+		t.Fatalf("IdentifyFile: %v", err)
+	}
+	if !strings.HasPrefix(got, "LevelDB table data") {
+		t.Errorf("IdentifyFile = %q, want LevelDB table data", got)
+	}
+}
+
+func TestIdentifyReaderAt_TextPhase(t *testing.T) {
+	fi, err := NewFromFS(fstest.MapFS{"test": {Data: []byte(`
+0	string/t	Hello	hello
+>-4	string	ZZZZ	\b, raw tail
+`)}}, Options{BytesMax: 4096})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+
+	// A UTF-16LE file longer than the bytes window. Text rules see the
+	// decoded window, so the raw bytes at the end of the file are not
+	// at -4.
+	data := []byte{0xff, 0xfe}
+	for _, c := range "Hello " + strings.Repeat("world ", 1000) {
+		data = append(data, byte(c), 0)
+	}
+	data = append(data, "ZZZZ"...)
+
+	want := fi.IdentifyBuffer(data)
+	if strings.Contains(want, "raw tail") {
+		t.Fatalf("IdentifyBuffer = %q, want no raw tail", want)
+	}
+	got, err := fi.IdentifyReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("IdentifyReaderAt: %v", err)
+	}
+	if got != want {
+		t.Errorf("IdentifyReaderAt = %q, want %q as from IdentifyBuffer", got, want)
+	}
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r    *bytes.Reader
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestIdentifyReaderAt_ReadsPrefix(t *testing.T) {
+	fi, err := NewFromFS(fstest.MapFS{"test": {Data: []byte(`
+0	string	HDR	header
+>0x400000	string	DEEP	\b, deep
+`)}}, Options{})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+
+	// Only the leading bytes are read before matching, not the whole
+	// BytesMax window; the rule past them reads what it tests.
+	data := make([]byte, 16<<20)
+	copy(data, "HDR")
+	copy(data[0x400000:], "DEEP")
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	got, err := fi.IdentifyReaderAt(r, int64(len(data)))
+	if err != nil {
+		t.Fatalf("IdentifyReaderAt: %v", err)
+	}
+	if want := "header, deep"; got != want {
+		t.Errorf("IdentifyReaderAt = %q, want %q", got, want)
+	}
+	if want := int64(prefixMax + len("DEEP")); r.read != want {
+		t.Errorf("IdentifyReaderAt read %d bytes, want %d", r.read, want)
+	}
+}
+
+func TestIdentifyReader_ReadsAsNeeded(t *testing.T) {
+	fi, err := NewFromFS(fstest.MapFS{"test": {Data: []byte(`
+0	string	HDR	header
+>0x20000	string	DEEP	\b, deep
+0	string	END	end
+>-4	string	TAIL	\b, tail
+`)}}, Options{})
+	if err != nil {
+		t.Fatalf("NewFromFS: %v", err)
+	}
+
+	stream := func(size int, writes map[int]string) []byte {
+		data := make([]byte, size)
+		for off, s := range writes {
+			copy(data[off:], s)
+		}
+		return data
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		want     string
+		consumed int
+	}{
+		// The encoding window, one byte to see that the stream goes on,
+		// and the bytes the rule past them tests.
+		{"deep", stream(16<<20, map[int]string{0: "HDR", 0x20000: "DEEP"}), "header, deep", 0x20000 + len("DEEP")},
+		// Content no rule identifies needs only the encoding window.
+		{"data", stream(16<<20, nil), "data", DefaultEncodingMax + 1},
+		// An offset from the end reads the stream to its end...
+		{"tail", stream(1<<20, map[int]string{0: "END", 1<<20 - 4: "TAIL"}), "end, tail", 1 << 20},
+		// ...or to the bytes limit, which it is then measured from.
+		{"limit", stream(16<<20, map[int]string{0: "END", DefaultBytesMax - 4: "TAIL"}), "end, tail", DefaultBytesMax},
+	}
+	for _, tt := range tests {
+		r := bytes.NewReader(tt.data)
+		got, err := fi.IdentifyReader(r)
+		if err != nil {
+			t.Fatalf("%s: IdentifyReader: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: IdentifyReader = %q, want %q", tt.name, got, tt.want)
+		}
+		if consumed := r.Size() - int64(r.Len()); consumed != int64(tt.consumed) {
+			t.Errorf("%s: IdentifyReader consumed %d bytes, want %d", tt.name, consumed, tt.consumed)
+		}
+	}
+}
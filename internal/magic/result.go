@@ -0,0 +1,159 @@
+package magic
+
+import "strings"
+
+// Source identifies the identification phase that produced a Result.
+type Source uint8
+
+const (
+	SourceNone      Source = iota // no identification was made
+	SourceFS                      // filesystem metadata (directory, symlink, empty, ...)
+	SourceSoftMagic               // a binary magic rule
+	SourceJSON                    // JSON / NDJSON detection (is_json.c)
+	SourceText                    // text detection, optionally refined by text magic rules
+	SourceELF                     // a magic rule enriched with ELF header analysis
+	SourceData                    // nothing matched; generic "data"
+)
+
+// String returns the phase name.
+func (s Source) String() string {
+	switch s {
+	case SourceFS:
+		return "filesystem"
+	case SourceSoftMagic:
+		return "softmagic"
+	case SourceJSON:
+		return "json"
+	case SourceText:
+		return "text"
+	case SourceELF:
+		return "elf"
+	case SourceData:
+		return "data"
+	default:
+		return "none"
+	}
+}
+
+// Result is the structured outcome of identifying a file.
+type Result struct {
+	// Desc is the human-readable description, as printed by file(1).
+	Desc string
+	// MimeType is the MIME type of the matched rule, if it has one.
+	MimeType string
+	// Encoding is the charset of the content (e.g. "us-ascii", "binary").
+	Encoding string
+	// Extensions lists the file extensions suggested by the matched rule,
+	// taken from the deepest matched continuation carrying !:ext.
+	Extensions []string
+	// Apple is the 8-character Apple creator/type code of the matched rule
+	// (e.g. "8BIMJPEG"), empty if the rule has none.
+	Apple string
+	// Strength is the strength of the matched top-level rule, 0 if no rule matched.
+	Strength int
+	// Source is the phase that produced the result.
+	Source Source
+}
+
+// String returns the description.
+func (r Result) String() string {
+	return r.Desc
+}
+
+// ruleMeta collects the !:mime, !:apple and !:ext annotations of the
+// entries that matched while evaluating one group, in evaluation order. A
+// nil *ruleMeta discards them.
+type ruleMeta struct {
+	mime  string
+	apple string
+
+	ext      string
+	extLevel int // continuation level of the entry that supplied ext
+	level    int // level of the 'use' entry whose named group is being evaluated
+}
+
+// add records the annotations of a matched entry. Like file(1) in -i and
+// --apple mode, the first matched entry carrying a MIME type or Apple code
+// wins. Extensions come from the deepest matched entry carrying !:ext, the
+// first one on ties.
+func (rm *ruleMeta) add(e *MagicEntry) {
+	if rm == nil {
+		return
+	}
+	if rm.mime == "" {
+		rm.mime = e.MimeType
+	}
+	if rm.apple == "" {
+		rm.apple = e.Apple
+	}
+	if e.Ext != "" {
+		rm.setExt(e.Ext, rm.level+int(e.ContLevel))
+	}
+}
+
+// addResult records the annotations of a nested (indirect) match made by
+// an entry at continuation level cl.
+func (rm *ruleMeta) addResult(r Result, cl int) {
+	if rm == nil {
+		return
+	}
+	if rm.mime == "" {
+		rm.mime = r.MimeType
+	}
+	if rm.apple == "" {
+		rm.apple = r.Apple
+	}
+	if len(r.Extensions) > 0 {
+		rm.setExt(strings.Join(r.Extensions, "/"), rm.level+cl+1)
+	}
+}
+
+func (rm *ruleMeta) setExt(ext string, level int) {
+	if rm.ext == "" || level > rm.extLevel {
+		rm.ext = ext
+		rm.extLevel = level
+	}
+}
+
+// enter shifts continuation levels for the named group called by a 'use'
+// entry at level cl, and returns the previous shift for leave.
+func (rm *ruleMeta) enter(cl int) int {
+	if rm == nil {
+		return 0
+	}
+	prev := rm.level
+	rm.level += cl
+	return prev
+}
+
+// leave restores the level shift returned by enter.
+func (rm *ruleMeta) leave(prev int) {
+	if rm != nil {
+		rm.level = prev
+	}
+}
+
+// groupResult builds a Result for a description produced by group.
+func groupResult(desc string, group *MagicGroup, meta *ruleMeta, src Source) Result {
+	top := group.Entries[0]
+	ext := meta.ext
+	if ext == "" {
+		ext = top.Ext
+	}
+	return Result{
+		Desc:       desc,
+		MimeType:   meta.mime,
+		Extensions: splitExt(ext),
+		Apple:      meta.apple,
+		Strength:   group.Strength,
+		Source:     src,
+	}
+}
+
+// splitExt splits a !:ext value such as "jpeg/jpg/jpe" into its extensions.
+func splitExt(ext string) []string {
+	if ext == "" {
+		return nil
+	}
+	return strings.Split(ext, "/")
+}
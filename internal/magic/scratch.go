@@ -0,0 +1,208 @@
+package magic
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// statePool recycles matchStates, and with them their scratch buffers, so
+// that a warmed-up identification allocates little beyond its Result.
+var statePool = sync.Pool{New: func() any { return new(matchState) }}
+
+// newState returns the state for one identification call. The caller must
+// release it once the Result has been built.
+func (m *Matcher) newState(ctx context.Context, mode os.FileMode) *matchState {
+	s := statePool.Get().(*matchState)
+	s.Matcher, s.fileMode, s.done, s.ctx = m, mode, ctx.Done(), ctx
+	if s.cancelFn == nil {
+		s.cancelFn = s.canceled
+	}
+	return s
+}
+
+// release resets s, keeping its scratch buffers, and returns it to the pool.
+// A panic can unwind a call mid-match, so the per-call counters are reset
+// here rather than relied on to return to zero.
+func (s *matchState) release() {
+	s.Matcher, s.ctx, s.done, s.err = nil, nil, nil, nil
+	s.depth, s.nameDepth, s.swap, s.fileMode, s.ra = 0, 0, false, 0, randomAccess{}
+	s.levels = s.levels[:0]
+	if cap(s.win) > windowPoolMax {
+		s.win = nil // a large search window is not worth keeping
+	}
+	statePool.Put(s)
+}
+
+// levelState tracks one continuation level while processing a group.
+type levelState struct {
+	matched       bool
+	matchedOffset int
+	siblingMatch  bool // for default type
+}
+
+// pushLevels returns n cleared levels from the state's level stack. Groups
+// nest through use and indirect, so the stack holds the levels of every
+// group being processed; popLevels releases them.
+func (s *matchState) pushLevels(n int) []levelState {
+	start := len(s.levels)
+	s.levels = slices.Grow(s.levels, n)[:start+n]
+	levels := s.levels[start:]
+	clear(levels)
+	return levels
+}
+
+func (s *matchState) popLevels(n int) {
+	s.levels = s.levels[:len(s.levels)-n]
+}
+
+// descBuffer accumulates the text of a description rendered from a
+// descRecord. Buffers are reused across calls.
+type descBuffer struct {
+	b []byte
+}
+
+func (d *descBuffer) Len() int          { return len(d.b) }
+func (d *descBuffer) Reset()            { d.b = d.b[:0] }
+func (d *descBuffer) String() string    { return string(d.b) }
+func (d *descBuffer) add(s string)      { d.b = append(d.b, s...) }
+func (d *descBuffer) addBytes(b []byte) { d.b = append(d.b, b...) }
+func (d *descBuffer) addByte(c byte)    { d.b = append(d.b, c) }
+func (d *descBuffer) hasPrefix(p string) bool {
+	return len(d.b) >= len(p) && string(d.b[:len(p)]) == p
+}
+
+// getDesc returns an empty description buffer; putDesc gives it back.
+func (s *matchState) getDesc() *descBuffer {
+	if n := len(s.descs); n > 0 {
+		d := s.descs[n-1]
+		s.descs = s.descs[:n-1]
+		return d
+	}
+	return new(descBuffer)
+}
+
+func (s *matchState) putDesc(d *descBuffer) {
+	d.Reset()
+	s.descs = append(s.descs, d)
+}
+
+// descRecord records how the description of a group is built while the
+// group is matched: which entries matched with which values, in order.
+// Candidate groups only record; the description of the winning group is
+// formatted from its record by render.
+type descRecord struct {
+	ops     []descOp
+	strs    []byte // copies of the string values in ops
+	printed bool   // whether the rendered description is non-empty
+}
+
+// descOp is one step of a description.
+type descOp struct {
+	kind  descOpKind
+	entry *MagicEntry // descTop, descEntry: the entry whose Desc is printed
+	val   Value       // the value entry matched
+	text  string      // descText
+	group *MagicGroup // descUse: the named group
+	n     int         // descUse: the number of ops of the named group that follow
+}
+
+type descOpKind uint8
+
+const (
+	descTop   descOpKind = iota // entry.Desc, added as is
+	descEntry                   // entry.Desc, added by appendDesc
+	descText                    // text, added by appendDesc
+	descUse                     // the output of a named group, joined by joinUse
+)
+
+func (r *descRecord) reset() {
+	r.ops, r.strs, r.printed = r.ops[:0], r.strs[:0], false
+}
+
+// record adds the description of entry, matched with val.
+func (s *matchState) record(r *descRecord, kind descOpKind, entry *MagicEntry, val Value) {
+	if entry.Desc == "" {
+		return
+	}
+	if !strings.Contains(entry.Desc, "%") {
+		val = Value{}
+	} else if val.Str != nil {
+		// The value may alias the window buffer, which the next read reuses.
+		start := len(r.strs)
+		r.strs = append(r.strs, val.Str...)
+		val.Str = r.strs[start:len(r.strs):len(r.strs)]
+	}
+	r.ops = append(r.ops, descOp{kind: kind, entry: entry, val: val})
+	if !r.printed {
+		desc := entry.Desc
+		if kind == descEntry {
+			desc = strings.TrimPrefix(desc, `\b`)
+		}
+		r.printed = !s.formatsEmpty(desc, val)
+	}
+}
+
+// recordText adds text, the description of a nested identification.
+func (r *descRecord) recordText(text string) {
+	r.ops = append(r.ops, descOp{kind: descText, text: text})
+	r.printed = r.printed || text != "" && text != `\b`
+}
+
+// beginUse starts the output of the named group called by a use entry.
+// It returns what endUse needs to close it.
+func (r *descRecord) beginUse(group *MagicGroup) (mark int, printed bool) {
+	r.ops = append(r.ops, descOp{kind: descUse, group: group})
+	printed, r.printed = r.printed, false
+	return len(r.ops) - 1, printed
+}
+
+// endUse closes the output of a named group and reports whether it printed
+// anything. Output that prints nothing is dropped.
+func (r *descRecord) endUse(mark int, printed bool) bool {
+	used := r.printed
+	if used {
+		r.ops[mark].n = len(r.ops) - mark - 1
+	} else {
+		r.ops = r.ops[:mark]
+	}
+	r.printed = printed || used
+	return used
+}
+
+// getRecord returns an empty description record; putRecord gives it back.
+func (s *matchState) getRecord() *descRecord {
+	if n := len(s.records); n > 0 {
+		r := s.records[n-1]
+		s.records = s.records[:n-1]
+		return r
+	}
+	return new(descRecord)
+}
+
+func (s *matchState) putRecord(r *descRecord) {
+	r.reset()
+	s.records = append(s.records, r)
+}
+
+// getFilter returns the group filter for buf; putFilter gives it back.
+func (s *matchState) getFilter(buf []byte) *groupFilter {
+	var f *groupFilter
+	if n := len(s.filters); n > 0 {
+		f = s.filters[n-1]
+		s.filters = s.filters[:n-1]
+	} else {
+		f = new(groupFilter)
+	}
+	// Whether the input continues past buf is all the filter needs, so a
+	// stream is read only one byte further.
+	f.reset(s.set.index, buf, s.inputEnd(buf, len(buf)+1), s.cancelFn)
+	return f
+}
+
+func (s *matchState) putFilter(f *groupFilter) {
+	f.buf, f.canceled = nil, nil
+	s.filters = append(s.filters, f)
+}
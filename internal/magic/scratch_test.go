@@ -0,0 +1,133 @@
+package magic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// maxMatchAllocs bounds the allocations of a warmed-up MatchResult call.
+// Scratch state and buffers are pooled and only the winning description
+// is formatted, so what remains is mostly the Result itself.
+const maxMatchAllocs = 4
+
+func TestMatchResult_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+	m := NewMatcher(loadTestMagicSet(t))
+	tests := []struct {
+		name string
+		buf  []byte
+		want string // description prefix
+	}{
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\x01\x00\x00\x00\x01\x00\x08\x06\x00\x00\x00"), "PNG image data"},
+		{"pdf", []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n"), "PDF document"},
+		{"gzip", []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\x03"), "gzip compressed data"},
+		{"shell", []byte("#!/bin/sh\necho hello\n"), "POSIX shell script"},
+		{"text", []byte(strings.Repeat("hello world, this is text.\n", 200)), "ASCII text"},
+		{"zeros", make([]byte, 4096), "data"},
+	}
+	for _, tt := range tests {
+		if got := m.MatchResult(tt.buf).Desc; !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: MatchResult = %q, want prefix %q", tt.name, got, tt.want)
+			continue
+		}
+		allocs := testing.AllocsPerRun(20, func() { m.MatchResult(tt.buf) })
+		if allocs > maxMatchAllocs {
+			t.Errorf("%s: MatchResult allocates %.0f times, want at most %d", tt.name, allocs, maxMatchAllocs)
+		}
+	}
+}
+
+func TestMatchReaderAt_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+	// Each rule past the header reads past the buffer.
+	rules := "0\tstring\tHDR\theader\n"
+	data := make([]byte, 0x10000)
+	copy(data, "HDR")
+	want := "header"
+	for i := 1; i <= 8; i++ {
+		off := i * 0x1000
+		rules += fmt.Sprintf(">%#x\tstring\tR%d\t\\b, r%d\n", off, i, i)
+		copy(data[off:], fmt.Sprintf("R%d", i))
+		want += fmt.Sprintf(", r%d", i)
+	}
+	m := NewMatcher(&MagicSet{Entries: mustParse(t, rules)})
+	r := bytes.NewReader(data)
+	match := func() string {
+		res, err := m.MatchReaderAt(context.Background(), data[:16], r, int64(len(data)), 0)
+		if err != nil {
+			t.Fatalf("MatchReaderAt: %v", err)
+		}
+		return res.Desc
+	}
+	if got := match(); got != want {
+		t.Fatalf("MatchReaderAt = %q, want %q", got, want)
+	}
+	// Reads past the buffer go through the pooled window buffer.
+	if allocs := testing.AllocsPerRun(20, func() { match() }); allocs > maxMatchAllocs {
+		t.Errorf("MatchReaderAt allocates %.0f times, want at most %d", allocs, maxMatchAllocs)
+	}
+}
+
+func BenchmarkMatchResult_Allocs(b *testing.B) {
+	set, err := ParseMagicDir(magicDir)
+	if err != nil {
+		b.Fatalf("ParseMagicDir: %v", err)
+	}
+	m := NewMatcher(set)
+	samples := [][]byte{
+		[]byte("#!/bin/sh\necho hello\n"),
+		[]byte(strings.Repeat("hello world, this is text.\n", 200)),
+		make([]byte, 4096),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MatchResult(samples[i%len(samples)])
+	}
+}
+
+// faultReader panics on every read, like a mapping of a file that shrank.
+type faultReader struct{}
+
+func (faultReader) ReadAt([]byte, int64) (int, error) { panic("fault") }
+
+func TestRelease_MidUse(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+	set := &MagicSet{Entries: mustParse(t, `
+0	name	inner
+>0	byte	x
+>>0x100	string	X	\b, far
+0	string	OUTER	outer
+>0	use	inner
+`)}
+	lim := defaultLimits
+	lim.name = 1
+	m := newMatcher(set, lim)
+	buf := []byte("OUTER")
+
+	// The read past buf panics inside the use, and the state is released
+	// while unwinding.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("MatchReaderAt did not panic")
+			}
+		}()
+		_, _ = m.MatchReaderAt(context.Background(), buf, faultReader{}, 0x200, 0)
+	}()
+
+	// The next call gets the released state; the use that never returned
+	// must not count against its name limit.
+	if got, want := m.Match(buf), "outer"; got != want {
+		t.Errorf("Match after a panic = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,380 @@
+package magic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"slices"
+)
+
+// A snapshot is a MagicSet serialized after parsing, so that loading it
+// skips parsing the magic files and sorting the groups.
+//
+// The format is the snapshotMagic prefix and a uvarint version, followed by
+// a string table and the entries, groups, named rules and diagnostics of
+// the set. Integers are varints, strings are indices into the string table,
+// and byte values are stored as their length plus one, zero meaning nil.
+// Groups refer to runs of entries, which buildGroups guarantees. Compiled
+// regexes and the group index are rebuilt when the snapshot is read.
+const (
+	snapshotMagic   = "GOFILESNAP"
+	snapshotVersion = 1
+)
+
+var errSnapshotCorrupt = errors.New("corrupt magic snapshot")
+
+// entry flag bits in a snapshot
+const (
+	snapUnsigned = 1 << iota
+	snapIsString
+	snapHasMask
+)
+
+// WriteSnapshot writes set to w in the snapshot format.
+func (set *MagicSet) WriteSnapshot(w io.Writer) error {
+	var sw snapshotWriter
+	entryIndex := make(map[*MagicEntry]int, len(set.Entries))
+	sw.uvarint(uint64(len(set.Entries)))
+	for i, e := range set.Entries {
+		entryIndex[e] = i
+		sw.entry(e)
+	}
+
+	sw.uvarint(uint64(len(set.Groups)))
+	for i, g := range set.Groups {
+		if len(g.Entries) == 0 {
+			return fmt.Errorf("writing snapshot: group %d is empty", i)
+		}
+		start, ok := entryIndex[g.Entries[0]]
+		for j, e := range g.Entries {
+			if k, found := entryIndex[e]; !ok || !found || k != start+j {
+				return fmt.Errorf("writing snapshot: group %d is not a run of set entries", i)
+			}
+		}
+		sw.varint(int64(g.Strength))
+		sw.uvarint(uint64(start))
+		sw.uvarint(uint64(len(g.Entries)))
+	}
+
+	sw.uvarint(uint64(len(set.NamedRules)))
+	for _, name := range slices.Sorted(maps.Keys(set.NamedRules)) {
+		sw.str(name)
+		sw.uvarint(uint64(set.NamedRules[name]))
+	}
+
+	sw.uvarint(uint64(len(set.Diagnostics)))
+	for _, d := range set.Diagnostics {
+		sw.str(d.File)
+		sw.varint(int64(d.Line))
+		sw.str(d.Msg)
+	}
+
+	header := binary.AppendUvarint([]byte(snapshotMagic), snapshotVersion)
+	header = binary.AppendUvarint(header, uint64(len(sw.table)))
+	for _, s := range sw.table {
+		header = binary.AppendUvarint(header, uint64(len(s)))
+		header = append(header, s...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(sw.buf)
+	return err
+}
+
+// snapshotWriter encodes the body of a snapshot, collecting its strings.
+type snapshotWriter struct {
+	buf   []byte
+	table []string
+	ids   map[string]uint64
+}
+
+func (w *snapshotWriter) uvarint(v uint64) { w.buf = binary.AppendUvarint(w.buf, v) }
+func (w *snapshotWriter) varint(v int64)   { w.buf = binary.AppendVarint(w.buf, v) }
+
+func (w *snapshotWriter) str(s string) {
+	id, ok := w.ids[s]
+	if !ok {
+		if w.ids == nil {
+			w.ids = make(map[string]uint64)
+		}
+		id = uint64(len(w.table))
+		w.ids[s] = id
+		w.table = append(w.table, s)
+	}
+	w.uvarint(id)
+}
+
+func (w *snapshotWriter) bytes(b []byte) {
+	if b == nil {
+		w.uvarint(0)
+		return
+	}
+	w.uvarint(uint64(len(b)) + 1)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *snapshotWriter) entry(e *MagicEntry) {
+	var flags uint64
+	if e.Unsigned {
+		flags |= snapUnsigned
+	}
+	if e.Value.IsString {
+		flags |= snapIsString
+	}
+	if e.HasMask {
+		flags |= snapHasMask
+	}
+	w.uvarint(flags)
+	w.uvarint(uint64(e.ContLevel))
+	w.varint(int64(e.Offset))
+	w.uvarint(uint64(e.Type))
+	w.uvarint(uint64(e.Relation))
+	w.uvarint(e.Value.Numeric)
+	w.uvarint(math.Float64bits(e.Value.Float))
+	w.bytes(e.Value.Str)
+	w.str(e.Desc)
+	w.str(e.MimeType)
+	w.str(e.Ext)
+	w.str(e.Apple)
+	w.varint(int64(e.LineNo))
+	w.str(e.Filename)
+	w.uvarint(uint64(e.StrRange))
+	w.uvarint(uint64(e.StrFlags))
+	w.uvarint(e.NumMask)
+	w.uvarint(uint64(e.MaskOp))
+	w.uvarint(uint64(e.Flag))
+	w.uvarint(uint64(e.InType))
+	w.uvarint(uint64(e.InOp))
+	w.varint(int64(e.InOffset))
+	w.uvarint(uint64(e.StrengthOp))
+	w.varint(int64(e.StrengthDelta))
+	w.varint(e.DateBias)
+}
+
+// ReadSnapshot reads a MagicSet written by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*MagicSet, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	return decodeSnapshot(data)
+}
+
+// decodeSnapshot decodes a snapshot. The set does not reference data.
+func decodeSnapshot(data []byte) (*MagicSet, error) {
+	if len(data) < len(snapshotMagic) || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("not a magic snapshot")
+	}
+	r := &snapshotReader{data: data[len(snapshotMagic):]}
+	if v := r.uvarint(); r.err == nil && v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported magic snapshot version %d", v)
+	}
+
+	r.table = make([]string, r.count())
+	for i := range r.table {
+		r.table[i] = string(r.next(int(r.count())))
+	}
+
+	set := &MagicSet{Entries: make([]*MagicEntry, r.count())}
+	entries := make([]MagicEntry, len(set.Entries))
+	for i := range set.Entries {
+		set.Entries[i] = &entries[i]
+		r.entry(&entries[i])
+	}
+
+	set.Groups = make([]MagicGroup, r.count())
+	for i := range set.Groups {
+		g := &set.Groups[i]
+		g.Strength = int(r.varint())
+		start, n := r.uvarint(), r.uvarint()
+		if r.err == nil && (n == 0 || start > uint64(len(set.Entries)) || n > uint64(len(set.Entries))-start) {
+			r.err = errSnapshotCorrupt
+		}
+		if r.err != nil {
+			break
+		}
+		g.Entries = set.Entries[start : start+n : start+n]
+	}
+
+	set.NamedRules = make(map[string]int)
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		name := r.str()
+		i := r.uvarint()
+		if i >= uint64(len(set.Groups)) {
+			r.err = errSnapshotCorrupt
+		}
+		set.NamedRules[name] = int(i)
+	}
+
+	if n := r.count(); n > 0 {
+		set.Diagnostics = make([]Diagnostic, n)
+		for i := range set.Diagnostics {
+			set.Diagnostics[i] = Diagnostic{File: r.str(), Line: int(r.varint()), Msg: r.str()}
+		}
+	}
+
+	if r.err == nil && len(r.data) != 0 {
+		r.err = errSnapshotCorrupt
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// The diagnostics of the patterns that do not compile were recorded
+	// when the snapshot was written.
+	set.index = buildGroupIndex(set.Groups)
+	set.compileRegexes()
+	return set, nil
+}
+
+// NewFromSnapshot creates a FileIdentifier from a snapshot file written by
+// WriteSnapshot.
+func NewFromSnapshot(path string, opts Options) (*FileIdentifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	set, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newFileIdentifier(set, opts), nil
+}
+
+// WriteSnapshot writes the loaded magic rules to w as a snapshot, which
+// NewFromSnapshot loads without parsing the original magic files.
+func (fi *FileIdentifier) WriteSnapshot(w io.Writer) error {
+	return fi.set.WriteSnapshot(w)
+}
+
+// isSnapshotFile reports whether the file at path starts with the snapshot
+// prefix.
+func isSnapshotFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	prefix := make([]byte, len(snapshotMagic))
+	_, err = io.ReadFull(f, prefix)
+	return err == nil && string(prefix) == snapshotMagic
+}
+
+// snapshotReader decodes a snapshot body. The first error is sticky: once
+// it is set, reads return zero values.
+type snapshotReader struct {
+	data  []byte
+	table []string
+	err   error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errSnapshotCorrupt
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errSnapshotCorrupt
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a length. Every counted item takes at least one byte, so a
+// count larger than the remaining data is corrupt; this bounds allocations.
+func (r *snapshotReader) count() uint64 {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = errSnapshotCorrupt
+		return 0
+	}
+	return n
+}
+
+// next consumes n bytes.
+func (r *snapshotReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errSnapshotCorrupt
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *snapshotReader) str() string {
+	id := r.uvarint()
+	if id >= uint64(len(r.table)) {
+		if r.err == nil {
+			r.err = errSnapshotCorrupt
+		}
+		return ""
+	}
+	return r.table[id]
+}
+
+func (r *snapshotReader) bytes() []byte {
+	n := r.uvarint()
+	if n == 0 || n-1 > uint64(len(r.data)) {
+		if n != 0 {
+			r.err = errSnapshotCorrupt
+		}
+		return nil
+	}
+	b := make([]byte, n-1)
+	copy(b, r.next(int(n-1)))
+	return b
+}
+
+func (r *snapshotReader) entry(e *MagicEntry) {
+	flags := r.uvarint()
+	e.Unsigned = flags&snapUnsigned != 0
+	e.Value.IsString = flags&snapIsString != 0
+	e.HasMask = flags&snapHasMask != 0
+	e.ContLevel = uint8(r.uvarint())
+	e.Offset = int32(r.varint())
+	e.Type = FileType(r.uvarint())
+	e.Relation = byte(r.uvarint())
+	e.Value.Numeric = r.uvarint()
+	e.Value.Float = math.Float64frombits(r.uvarint())
+	e.Value.Str = r.bytes()
+	e.Desc = r.str()
+	e.MimeType = r.str()
+	e.Ext = r.str()
+	e.Apple = r.str()
+	e.LineNo = int(r.varint())
+	e.Filename = r.str()
+	e.StrRange = uint32(r.uvarint())
+	e.StrFlags = uint32(r.uvarint())
+	e.NumMask = r.uvarint()
+	e.MaskOp = byte(r.uvarint())
+	e.Flag = uint16(r.uvarint())
+	e.InType = FileType(r.uvarint())
+	e.InOp = byte(r.uvarint())
+	e.InOffset = int32(r.varint())
+	e.StrengthOp = byte(r.uvarint())
+	e.StrengthDelta = int(r.varint())
+	e.DateBias = r.varint()
+}
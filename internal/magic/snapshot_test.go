@@ -0,0 +1,189 @@
+package magic
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEmbeddedSnapshot(t *testing.T) {
+	want := loadTestMagicSet(t)
+	got, err := decodeSnapshot(embeddedSnapshot)
+	if err != nil {
+		t.Fatalf("decodeSnapshot: %v", err)
+	}
+	if reflect.DeepEqual(got, want) {
+		return
+	}
+	const stale = "; run go generate ./internal/magic"
+	if len(got.Entries) != len(want.Entries) {
+		t.Fatalf("snapshot has %d entries, ParseMagicDir %d%s", len(got.Entries), len(want.Entries), stale)
+	}
+	for i := range want.Entries {
+		if !reflect.DeepEqual(got.Entries[i], want.Entries[i]) {
+			t.Fatalf("snapshot entry %d = %+v, ParseMagicDir %+v%s", i, got.Entries[i], want.Entries[i], stale)
+		}
+	}
+	t.Fatalf("snapshot groups, named rules or diagnostics differ from ParseMagicDir%s", stale)
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, `
+0	string/cW	\x7fELF	ELF
+!:mime	application/x-elf
+!:ext	so/o
+!:apple	????ELF
+!:strength	+10
+>4	byte&0x0f	1	32-bit
+>(0x18.l+4)	ubelong	!0	%#x
+>>&-2	leshort	x	\b, %d
+0	name	part
+>0	regex	=^[a-z]+	word
+0	lefloat	>1.5	float
+0	search/100/t	needle	found
+>&0	use	part
+0	ledate-1	x	date %s
+`)}
+	set.buildGroups()
+
+	var buf bytes.Buffer
+	if err := set.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	got, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("ReadSnapshot: %v", err)
+	}
+	if !reflect.DeepEqual(got, set) {
+		t.Errorf("ReadSnapshot = %+v, want %+v", got, set)
+	}
+}
+
+// TestSnapshot_AllFields sets each exported field of a MagicEntry, and of
+// its Value, to a non-zero value in turn and checks that it round-trips, so
+// that a field added to MagicEntry cannot be left out of the format.
+func TestSnapshot_AllFields(t *testing.T) {
+	var fields []func(*MagicEntry) reflect.Value
+	entryType := reflect.TypeFor[MagicEntry]()
+	for i := range entryType.NumField() {
+		f := entryType.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Type == reflect.TypeFor[Value]() {
+			for j := range f.Type.NumField() {
+				fields = append(fields, func(e *MagicEntry) reflect.Value {
+					return reflect.ValueOf(&e.Value).Elem().Field(j)
+				})
+			}
+			continue
+		}
+		fields = append(fields, func(e *MagicEntry) reflect.Value {
+			return reflect.ValueOf(e).Elem().Field(i)
+		})
+	}
+
+	for _, field := range fields {
+		e := &MagicEntry{Type: TypeByte, Relation: '='}
+		v := field(e)
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(!v.Bool())
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			v.SetInt(-12345)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(v.Uint() ^ 0xa5)
+		case reflect.Float64:
+			v.SetFloat(-1.5)
+		case reflect.String:
+			v.SetString("some text")
+		case reflect.Slice:
+			v.SetBytes([]byte("\x00bytes"))
+		default:
+			t.Fatalf("no test value for a field of kind %s", v.Kind())
+		}
+		set := &MagicSet{Entries: []*MagicEntry{e}}
+		set.buildGroups()
+
+		var buf bytes.Buffer
+		if err := set.WriteSnapshot(&buf); err != nil {
+			t.Fatalf("WriteSnapshot: %v", err)
+		}
+		got, err := ReadSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("ReadSnapshot: %v", err)
+		}
+		if !reflect.DeepEqual(got.Entries[0], e) {
+			t.Errorf("ReadSnapshot entry = %+v, want %+v", got.Entries[0], e)
+		}
+	}
+}
+
+func TestNewFromPath_Snapshot(t *testing.T) {
+	fi, err := NewFromDir(magicDir, Options{})
+	if err != nil {
+		t.Fatalf("NewFromDir: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "magic.snap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fi.WriteSnapshot(f); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewFromPath(path, Options{})
+	if err != nil {
+		t.Fatalf("NewFromPath: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.set, fi.set) {
+		t.Error("NewFromPath of a snapshot loaded a different set than NewFromDir")
+	}
+}
+
+func TestReadSnapshot_Invalid(t *testing.T) {
+	set := &MagicSet{Entries: mustParse(t, "0\tstring\tabc\tABC\n>3\tbyte\t1\tone\n")}
+	set.buildGroups()
+	var buf bytes.Buffer
+	if err := set.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	data := buf.Bytes()
+
+	for n := range len(data) {
+		if _, err := decodeSnapshot(data[:n]); err == nil {
+			t.Errorf("decodeSnapshot of %d of %d bytes succeeded", n, len(data))
+		}
+	}
+	if _, err := decodeSnapshot(append(bytes.Clone(data), 0)); err == nil {
+		t.Error("decodeSnapshot with trailing data succeeded")
+	}
+	newer := append([]byte(snapshotMagic), snapshotVersion+1)
+	newer = append(newer, data[len(snapshotMagic)+1:]...)
+	if _, err := decodeSnapshot(newer); err == nil {
+		t.Error("decodeSnapshot of a newer version succeeded")
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	b.Run("snapshot", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeSnapshot(embeddedSnapshot); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parse", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ParseMagicDir(magicDir); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
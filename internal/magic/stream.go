@@ -0,0 +1,88 @@
+package magic
+
+import "io"
+
+// streamInput reads a stream as the rules need it, up to limit bytes, and
+// serves the bytes read so far through ReadAt. Reads past them read more
+// of the stream; finding its size reads it to the end or the limit.
+type streamInput struct {
+	r       io.Reader
+	bp      *[]byte   // pooled buffer holding the bytes read so far
+	retired []*[]byte // buffers outgrown while their bytes may still be in use
+	n       int       // bytes read so far
+	limit   int
+	err     error // error that ended the stream, io.EOF at its end
+}
+
+func newStreamInput(r io.Reader, limit int) *streamInput {
+	return &streamInput{r: r, bp: getReadBuf(0), limit: limit}
+}
+
+// release returns the buffers of st to readBufPool. Slices of them must no
+// longer be in use.
+func (st *streamInput) release() {
+	readBufPool.Put(st.bp)
+	for _, bp := range st.retired {
+		readBufPool.Put(bp)
+	}
+	st.bp, st.retired = nil, nil
+}
+
+// ended reports whether the stream has been read to its end, the limit or
+// an error, so that no more bytes will be read.
+func (st *streamInput) ended() bool {
+	return st.err != nil || st.n == st.limit
+}
+
+// fill reads the stream until it holds want bytes, if it is that long and
+// within the limit, and returns the number of bytes held.
+func (st *streamInput) fill(want int64) int {
+	want = min(want, int64(st.limit))
+	if want <= int64(st.n) || st.err != nil {
+		return st.n
+	}
+	if int64(cap(*st.bp)) < want {
+		// The bytes held may be referenced by the matcher, so they are
+		// copied rather than moved, and the old buffer is kept until release.
+		grown := make([]byte, st.n, min(max(want, 2*int64(cap(*st.bp))), int64(st.limit)))
+		copy(grown, *st.bp)
+		st.retired = append(st.retired, st.bp)
+		st.bp = &grown
+	}
+	data := (*st.bp)[:want]
+	got, err := io.ReadFull(st.r, data[st.n:])
+	st.n += got
+	*st.bp = data[:st.n]
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	st.err = err
+	return st.n
+}
+
+// prefix returns the first n bytes of the stream, or as many as it holds.
+// Bytes read past n by earlier calls are not included.
+func (st *streamInput) prefix(n int) []byte {
+	return (*st.bp)[:min(n, st.fill(int64(n)))]
+}
+
+// Size reads the stream to its end or the limit and returns its size.
+func (st *streamInput) Size() int64 {
+	return int64(st.fill(int64(st.limit)))
+}
+
+// ReadAt reads len(p) bytes at off, reading the stream as far as needed.
+func (st *streamInput) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, io.EOF
+	}
+	end := st.fill(off + int64(len(p)))
+	if off >= int64(end) {
+		return 0, io.EOF
+	}
+	n := copy(p, (*st.bp)[off:end])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -1,5 +1,10 @@
 package magic
 
+import (
+	"fmt"
+	"regexp"
+)
+
 // FileType represents the data type to read at the offset.
 type FileType uint8
 
@@ -81,6 +86,12 @@ type MagicSet struct {
 	Entries    []*MagicEntry
 	Groups     []MagicGroup
 	NamedRules map[string]int // name -> group index for "name"/"use" references
+
+	// Diagnostics lists problems found while loading the rules, such as
+	// regex patterns that do not compile.
+	Diagnostics []Diagnostic
+
+	index *groupIndex // prefilter over Groups, built by buildGroups
 }
 
 // MagicEntry represents one parsed magic rule line.
@@ -96,6 +107,7 @@ type MagicEntry struct {
 	Ext       string
 	Apple     string
 	LineNo    int
+	Filename  string // magic file the entry was parsed from, if known
 
 	// For search type: range to search within
 	StrRange uint32
@@ -118,4 +130,19 @@ type MagicEntry struct {
 
 	// Date bias (e.g., leldate+631065600 adds bias before formatting)
 	DateBias int64
+
+	// Compiled pattern of a regex entry, nil if it failed to compile
+	re *regexp.Regexp
+}
+
+// Diagnostic is a problem in a magic file found while loading it.
+type Diagnostic struct {
+	File string
+	Line int
+	Msg  string
+}
+
+// String formats the diagnostic the way file(1) prints magic warnings.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s, %d: Warning: %s", d.File, d.Line, d.Msg)
 }
@@ -1,14 +1,17 @@
 package magic
 
 import (
+	"bytes"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"math"
 )
 
 // extractValue reads a value from buf at the given offset using the entry's type.
+// String values alias buf rather than copying it and must not be modified.
 func extractValue(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 	if offset < 0 || offset >= len(buf) {
-		return Value{}, fmt.Errorf("offset %d out of bounds (len=%d)", offset, len(buf))
+		return Value{}, errShortBuffer
 	}
 
 	switch entry.Type {
@@ -17,40 +20,76 @@ func extractValue(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 
 	case TypeBEShort:
 		if offset+2 > len(buf) {
-			return Value{}, fmt.Errorf("need 2 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		return Value{Numeric: uint64(binary.BigEndian.Uint16(buf[offset:]))}, nil
 
 	case TypeLEShort, TypeShort:
 		if offset+2 > len(buf) {
-			return Value{}, fmt.Errorf("need 2 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		return Value{Numeric: uint64(binary.LittleEndian.Uint16(buf[offset:]))}, nil
 
 	case TypeBELong:
 		if offset+4 > len(buf) {
-			return Value{}, fmt.Errorf("need 4 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		return Value{Numeric: uint64(binary.BigEndian.Uint32(buf[offset:]))}, nil
 
 	case TypeLELong, TypeLong:
 		if offset+4 > len(buf) {
-			return Value{}, fmt.Errorf("need 4 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		return Value{Numeric: uint64(binary.LittleEndian.Uint32(buf[offset:]))}, nil
 
+	case TypeBEID3, TypeLEID3:
+		if offset+4 > len(buf) {
+			return Value{}, errShortBuffer
+		}
+		var v uint32
+		if entry.Type == TypeBEID3 {
+			v = binary.BigEndian.Uint32(buf[offset:])
+		} else {
+			v = binary.LittleEndian.Uint32(buf[offset:])
+		}
+		return Value{Numeric: uint64(id3Syncsafe(v))}, nil
+
 	case TypeBEQuad:
 		if offset+8 > len(buf) {
-			return Value{}, fmt.Errorf("need 8 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		return Value{Numeric: binary.BigEndian.Uint64(buf[offset:])}, nil
 
 	case TypeLEQuad, TypeQuad:
 		if offset+8 > len(buf) {
-			return Value{}, fmt.Errorf("need 8 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		return Value{Numeric: binary.LittleEndian.Uint64(buf[offset:])}, nil
 
+	case TypeFloat, TypeBEFloat, TypeLEFloat:
+		if offset+4 > len(buf) {
+			return Value{}, errShortBuffer
+		}
+		var v uint32
+		if entry.Type == TypeBEFloat {
+			v = binary.BigEndian.Uint32(buf[offset:])
+		} else {
+			v = binary.LittleEndian.Uint32(buf[offset:])
+		}
+		return Value{Float: float64(math.Float32frombits(v))}, nil
+
+	case TypeDouble, TypeBEDouble, TypeLEDouble:
+		if offset+8 > len(buf) {
+			return Value{}, errShortBuffer
+		}
+		var v uint64
+		if entry.Type == TypeBEDouble {
+			v = binary.BigEndian.Uint64(buf[offset:])
+		} else {
+			v = binary.LittleEndian.Uint64(buf[offset:])
+		}
+		return Value{Float: math.Float64frombits(v)}, nil
+
 	case TypeString:
 		return extractString(buf, offset, entry)
 
@@ -64,48 +103,23 @@ func extractValue(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 		return extractString16(buf, offset, entry, false)
 
 	case TypeSearch:
-		// Search for the pattern within StrRange bytes from offset.
-		// StrRange limits how far from offset the match can START, not end.
-		searchRange := int(entry.StrRange)
-		if searchRange == 0 {
-			searchRange = len(buf) - offset
-		}
-		// The match can start at any position from offset to offset+searchRange,
-		// but the pattern can extend beyond the search range.
-		endSearch := offset + searchRange + len(entry.Value.Str)*4
-		if endSearch > len(buf) {
-			endSearch = len(buf)
-		}
-		pattern := entry.Value.Str
-		region := buf[offset:endSearch]
-		wsFlags := entry.StrFlags & (StrFlagOptionalWS | StrFlagCompactWS)
-		if wsFlags != 0 {
-			idx, consumed := searchStringWS(region, pattern, searchRange, entry.StrFlags)
-			if idx < 0 {
-				return Value{}, fmt.Errorf("search pattern not found")
-			}
-			return Value{Str: pattern, IsString: true, Numeric: uint64(offset + idx + consumed)}, nil
-		}
-		caseInsensitive := entry.StrFlags&(StrFlagIgnoreLower|StrFlagIgnoreUpper) != 0
-		var idx int
-		if caseInsensitive {
-			idx = bytesIndexCI(region, pattern)
-		} else {
-			idx = bytesIndex(region, pattern)
-		}
-		if idx < 0 || idx > searchRange {
-			return Value{}, fmt.Errorf("search pattern not found")
-		}
-		return Value{Str: pattern, IsString: true, Numeric: uint64(offset + idx + len(pattern))}, nil
+		return extractSearch(buf, offset, entry, nil)
 
 	case TypeRegex:
-		return Value{}, fmt.Errorf("regex type not yet implemented")
+		return Value{}, errUnsupportedType
+
+	case TypeOctal:
+		v, n := parseOctal(buf[offset:])
+		if n == 0 {
+			return Value{}, errNoMatch
+		}
+		return Value{Numeric: v}, nil
 
 	case TypeBEDate, TypeLEDate, TypeDate,
 		TypeBELDate, TypeLELDate, TypeLDate,
 		TypeMEDate, TypeMELDate:
 		if offset+4 > len(buf) {
-			return Value{}, fmt.Errorf("need 4 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		var v uint32
 		switch entry.Type {
@@ -122,7 +136,7 @@ func extractValue(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 		TypeBEQLDate, TypeLEQLDate, TypeQLDate,
 		TypeBEQWDate, TypeLEQWDate, TypeQWDate:
 		if offset+8 > len(buf) {
-			return Value{}, fmt.Errorf("need 8 bytes at offset %d, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
 		var v uint64
 		switch entry.Type {
@@ -138,15 +152,13 @@ func extractValue(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 
 	case TypeGUID:
 		if offset+16 > len(buf) {
-			return Value{}, fmt.Errorf("need 16 bytes at offset %d for GUID, have %d", offset, len(buf))
+			return Value{}, errShortBuffer
 		}
-		data := make([]byte, 16)
-		copy(data, buf[offset:offset+16])
-		return Value{Str: data, IsString: true}, nil
+		return Value{Str: buf[offset : offset+16 : offset+16], IsString: true}, nil
 
 	case TypeLEMSDOSDate, TypeLEMSDOSTime, TypeBEMSDOSDate, TypeBEMSDOSTime:
 		if offset+2 > len(buf) {
-			return Value{}, fmt.Errorf("need 2 bytes at offset %d", offset)
+			return Value{}, errShortBuffer
 		}
 		var v uint16
 		switch entry.Type {
@@ -158,8 +170,103 @@ func extractValue(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 		return Value{Numeric: uint64(v)}, nil
 
 	default:
-		return Value{}, fmt.Errorf("unsupported type %d", entry.Type)
+		return Value{}, errUnsupportedType
+	}
+}
+
+// searchChunk is the number of start positions a search scans between
+// cancellation checks.
+const searchChunk = 64 * 1024
+
+// Errors returned while extracting values. Extraction fails routinely while
+// matching, so these are preallocated rather than formatted per failure.
+var (
+	errShortBuffer     = errors.New("value extends past end of input")
+	errNoMatch         = errors.New("pattern not found")
+	errUnsupportedType = errors.New("unsupported type")
+
+	// errCanceled reports that a scan was stopped by its canceled callback.
+	errCanceled = errors.New("scan canceled")
+)
+
+// extractSearch searches for the entry's pattern within StrRange bytes from
+// offset. If canceled is non-nil, it is polled every searchChunk start
+// positions and stops the search with errCanceled when it returns true.
+func extractSearch(buf []byte, offset int, entry *MagicEntry, canceled func() bool) (Value, error) {
+	// StrRange limits how far from offset the match can START, not end.
+	searchRange := int(entry.StrRange)
+	if searchRange == 0 {
+		searchRange = len(buf) - offset
+	}
+	// The match can start at any position from offset to offset+searchRange,
+	// but the pattern can extend beyond the search range.
+	endSearch := offset + searchRange + len(entry.Value.Str)*4
+	if endSearch > len(buf) {
+		endSearch = len(buf)
+	}
+	pattern := entry.Value.Str
+	region := buf[offset:endSearch]
+	wsFlags := entry.StrFlags & (StrFlagOptionalWS | StrFlagCompactWS)
+	caseInsensitive := entry.StrFlags&(StrFlagIgnoreLower|StrFlagIgnoreUpper) != 0
+
+	for start := 0; start <= searchRange && start < len(region); start += searchChunk {
+		if canceled != nil && canceled() {
+			return Value{}, errCanceled
+		}
+		last := min(start+searchChunk-1, searchRange) // last start position in this chunk
+		if wsFlags != 0 {
+			idx, consumed := searchStringWS(region[start:], pattern, last-start, entry.StrFlags)
+			if idx >= 0 {
+				return Value{Str: pattern, IsString: true, Numeric: uint64(offset + start + idx + consumed)}, nil
+			}
+			continue
+		}
+		window := region[start:min(len(region), last+len(pattern))]
+		var idx int
+		if caseInsensitive {
+			idx = bytesIndexCI(window, pattern)
+		} else {
+			idx = bytes.Index(window, pattern)
+		}
+		if idx >= 0 {
+			return Value{Str: pattern, IsString: true, Numeric: uint64(offset + start + idx + len(pattern))}, nil
+		}
 	}
+	return Value{}, errNoMatch
+}
+
+// octalFieldMax is the number of bytes an octal value is read from:
+// leading spaces and the 22 digits of the largest 64-bit value.
+const octalFieldMax = 32
+
+// parseOctal decodes the ASCII-octal number at the start of b, as found in
+// tar, cpio and ar headers. Leading spaces are skipped and the digits end
+// at the first other byte, usually a NUL or a space. It returns the value
+// and the number of bytes consumed, or 0 if b holds no octal number or its
+// value overflows.
+func parseOctal(b []byte) (uint64, int) {
+	i := 0
+	for i < len(b) && b[i] == ' ' {
+		i++
+	}
+	start := i
+	var v uint64
+	for ; i < len(b) && b[i] >= '0' && b[i] <= '7'; i++ {
+		if v > math.MaxUint64>>3 {
+			return 0, 0
+		}
+		v = v<<3 | uint64(b[i]-'0')
+	}
+	if i == start {
+		return 0, 0
+	}
+	return v, i
+}
+
+// id3Syncsafe decodes an ID3v2 syncsafe integer, which keeps 7 bits in
+// each byte so that the value never looks like an MPEG frame sync.
+func id3Syncsafe(v uint32) uint32 {
+	return v&0x7f | (v>>8&0x7f)<<7 | (v>>16&0x7f)<<14 | (v>>24&0x7f)<<21
 }
 
 // melong reads a 4-byte middle-endian (PDP-11) value.
@@ -177,10 +284,24 @@ func compare(extracted Value, entry *MagicEntry) bool {
 		return compareString(extracted.Str, entry.Value.Str, entry.Relation)
 	}
 
-	return compareNumeric(extracted.Numeric, entry.Value.Numeric, entry.Relation)
+	if isFloatType(entry.Type) {
+		return compareFloat(extracted.Float, entry.Value.Float, entry.Relation)
+	}
+
+	v, test := extracted.Numeric, entry.Value.Numeric
+	signed := false
+	if w := intWidth(entry.Type); w > 0 && !entry.Unsigned {
+		// Like file(1), sign-extend both sides by the width of the type.
+		v, test = signExtend(v, w), signExtend(test, w)
+		signed = true
+	}
+	return compareNumeric(v, test, entry.Relation, signed)
 }
 
-func compareNumeric(v, test uint64, rel byte) bool {
+// compareFloat compares floating-point values the way file(1) does: a NaN
+// is unequal to everything and neither less nor greater than anything. The
+// bitwise relations do not apply to floats and never match.
+func compareFloat(v, test float64, rel byte) bool {
 	switch rel {
 	case '=':
 		return v == test
@@ -190,6 +311,29 @@ func compareNumeric(v, test uint64, rel byte) bool {
 		return v < test
 	case '>':
 		return v > test
+	default:
+		return false
+	}
+}
+
+// compareNumeric applies rel to v and test, ordering them as int64 values
+// if signed.
+func compareNumeric(v, test uint64, rel byte, signed bool) bool {
+	switch rel {
+	case '=':
+		return v == test
+	case '!':
+		return v != test
+	case '<':
+		if signed {
+			return int64(v) < int64(test)
+		}
+		return v < test
+	case '>':
+		if signed {
+			return int64(v) > int64(test)
+		}
+		return v > test
 	case '&':
 		return v&test == test
 	case '^':
@@ -199,24 +343,33 @@ func compareNumeric(v, test uint64, rel byte) bool {
 	}
 }
 
-// bytesIndex finds the first occurrence of pattern in data.
-func bytesIndex(data, pattern []byte) int {
-	if len(pattern) == 0 {
-		return 0
+// intWidth returns the width in bytes of the integer types that file(1)
+// treats as signed unless they carry the u prefix, and 0 for other types.
+func intWidth(t FileType) int {
+	switch t {
+	case TypeByte:
+		return 1
+	case TypeShort, TypeBEShort, TypeLEShort:
+		return 2
+	case TypeLong, TypeBELong, TypeLELong, TypeMELong, TypeBEID3, TypeLEID3:
+		return 4
+	case TypeQuad, TypeBEQuad, TypeLEQuad:
+		return 8
 	}
-	for i := 0; i <= len(data)-len(pattern); i++ {
-		match := true
-		for j := 0; j < len(pattern); j++ {
-			if data[i+j] != pattern[j] {
-				match = false
-				break
-			}
-		}
-		if match {
-			return i
-		}
+	return 0
+}
+
+// signExtend sign-extends the low width bytes of v to 64 bits.
+func signExtend(v uint64, width int) uint64 {
+	switch width {
+	case 1:
+		return uint64(int8(v))
+	case 2:
+		return uint64(int16(v))
+	case 4:
+		return uint64(int32(v))
 	}
-	return -1
+	return v
 }
 
 // extractString extracts a string value from the buffer.
@@ -255,9 +408,7 @@ func extractString(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 				data = data[:len(data)-1]
 			}
 		}
-		result := make([]byte, len(data))
-		copy(result, data)
-		return Value{Str: result, IsString: true}, nil
+		return Value{Str: data[:len(data):len(data)], IsString: true}, nil
 	}
 	// Check for whitespace flags
 	wsFlags := entry.StrFlags & (StrFlagOptionalWS | StrFlagCompactWS)
@@ -274,7 +425,7 @@ func extractString(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 		}
 		_, ok := matchStringWS(buf[offset:end], entry.Value.Str, entry.StrFlags)
 		if !ok {
-			return Value{}, fmt.Errorf("whitespace-aware string match failed")
+			return Value{}, errNoMatch
 		}
 		// Use pattern length for matchEnd (continuation offsets are relative to pattern)
 		return Value{Str: entry.Value.Str, IsString: true}, nil
@@ -289,9 +440,7 @@ func extractString(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 	if end > len(buf) {
 		end = len(buf)
 	}
-	data := make([]byte, end-offset)
-	copy(data, buf[offset:end])
-	return Value{Str: data, IsString: true}, nil
+	return Value{Str: buf[offset:end:end], IsString: true}, nil
 }
 
 // extractPString extracts a pascal-style string (length-prefixed).
@@ -315,7 +464,7 @@ func extractPString(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 	}
 
 	if offset+prefixSize > len(buf) {
-		return Value{}, fmt.Errorf("pstring: need %d bytes for length prefix at offset %d", prefixSize, offset)
+		return Value{}, errShortBuffer
 	}
 
 	switch prefixSize {
@@ -341,11 +490,10 @@ func extractPString(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 		dataEnd = len(buf)
 	}
 	if dataStart > len(buf) {
-		return Value{}, fmt.Errorf("pstring: offset out of bounds")
+		return Value{}, errShortBuffer
 	}
 
-	data := make([]byte, dataEnd-dataStart)
-	copy(data, buf[dataStart:dataEnd])
+	data := buf[dataStart:dataEnd:dataEnd]
 	// Trim trailing null bytes (common in pstring formats)
 	trimmed := 0
 	for len(data) > 0 && data[len(data)-1] == 0 {
@@ -357,36 +505,43 @@ func extractPString(buf []byte, offset int, entry *MagicEntry) (Value, error) {
 	return Value{Str: data, IsString: true, Numeric: uint64(matchEnd)}, nil
 }
 
-// bytesIndexCI finds the first case-insensitive occurrence of pattern in data.
+// bytesIndexCI finds the first occurrence of pattern in data, ignoring
+// ASCII case.
 func bytesIndexCI(data, pattern []byte) int {
 	if len(pattern) == 0 {
 		return 0
 	}
-	for i := 0; i <= len(data)-len(pattern); i++ {
-		match := true
-		for j := 0; j < len(pattern); j++ {
-			a, b := data[i+j], pattern[j]
-			if a != b {
-				// Case insensitive compare
-				if a >= 'A' && a <= 'Z' {
-					a += 'a' - 'A'
-				}
-				if b >= 'A' && b <= 'Z' {
-					b += 'a' - 'A'
-				}
-				if a != b {
-					match = false
-					break
-				}
+	lower, upper := toLowerASCII(pattern[0]), toUpperASCII(pattern[0])
+	last := len(data) - len(pattern)
+	for i := 0; i <= last; i++ {
+		// Skip to the next position holding the first byte in either case.
+		if lower == upper {
+			j := bytes.IndexByte(data[i:last+1], lower)
+			if j < 0 {
+				return -1
 			}
+			i += j
+		} else if data[i] != lower && data[i] != upper {
+			continue
 		}
-		if match {
+		if equalFoldASCII(data[i:i+len(pattern)], pattern) {
 			return i
 		}
 	}
 	return -1
 }
 
+// equalFoldASCII reports whether a and b, of equal length, are equal
+// ignoring ASCII case. Unlike bytes.EqualFold it does not decode UTF-8.
+func equalFoldASCII(a, b []byte) bool {
+	for i := range a {
+		if a[i] != b[i] && toLowerASCII(a[i]) != toLowerASCII(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func compareString(v, test []byte, rel byte) bool {
 	n := len(test)
 	if n > len(v) {
@@ -523,7 +678,7 @@ func extractString16(buf []byte, offset int, entry *MagicEntry, littleEndian boo
 	// Exact match: read testLen*2 bytes, convert to single-byte
 	need := testLen * 2
 	if offset+need > len(buf) {
-		return Value{}, fmt.Errorf("need %d bytes at offset %d for string16", need, offset)
+		return Value{}, errShortBuffer
 	}
 	result := make([]byte, testLen)
 	for i := 0; i < testLen; i++ {
@@ -1,6 +1,8 @@
 package magic
 
 import (
+	"encoding/binary"
+	"math"
 	"testing"
 )
 
@@ -79,6 +81,104 @@ func TestExtractValue_String(t *testing.T) {
 	}
 }
 
+func TestExtractValue_Float(t *testing.T) {
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint32(buf[0:], math.Float32bits(1.5))
+	binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(-0.25))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(8.642135e+130))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(0.1))
+
+	tests := []struct {
+		typ    FileType
+		offset int
+		want   float64
+	}{
+		{TypeBEFloat, 0, 1.5},
+		{TypeLEFloat, 4, -0.25},
+		{TypeFloat, 4, -0.25},
+		{TypeBEDouble, 8, 8.642135e+130},
+		{TypeLEDouble, 16, 0.1},
+		{TypeDouble, 16, 0.1},
+	}
+	for _, tt := range tests {
+		val, err := extractValue(buf, tt.offset, &MagicEntry{Type: tt.typ})
+		if err != nil {
+			t.Errorf("type %d at %d: unexpected error: %v", tt.typ, tt.offset, err)
+			continue
+		}
+		if val.Float != tt.want {
+			t.Errorf("type %d at %d: Float = %g, want %g", tt.typ, tt.offset, val.Float, tt.want)
+		}
+	}
+	if _, err := extractValue(buf, 20, &MagicEntry{Type: TypeLEDouble}); err == nil {
+		t.Error("expected error for a double past the end of the buffer")
+	}
+}
+
+func TestCompare_Signed(t *testing.T) {
+	tests := []struct {
+		rule string
+		v    uint64
+		want bool
+	}{
+		{"0\tbyte\t<0", 0x80, true},
+		{"0\tubyte\t<0", 0x80, false},
+		{"0\tubyte\t>0x7f", 0x80, true},
+		{"0\tbyte\t>0", 0x80, false},
+		{"0\tbyte\t-1", 0xff, true},
+		{"0\tbyte\t0xff", 0xff, true},
+		{"0\tubyte\t-1", 0xff, false},
+		{"0\tleshort\t<-1", 0xfffe, true},
+		{"0\tleshort\t>-1", 0x7fff, true},
+		{"0\tuleshort\t<-1", 0xfffe, true},
+		{"0\tbelong\t<0", 0x80000000, true},
+		{"0\tubelong\t<0", 0x80000000, false},
+		{"0\tbelong\t>0", 0x7fffffff, true},
+		{"0\tlequad\t<0", 1 << 63, true},
+		{"0\tulequad\t>0", 1 << 63, true},
+		{"0\tbyte\t&0x80", 0x80, true},
+		{"0\tbyte\t^0x80", 0x7f, true},
+	}
+	for _, tt := range tests {
+		entry, err := parseLine(tt.rule, 1)
+		if err != nil {
+			t.Fatalf("parseLine(%q): %v", tt.rule, err)
+		}
+		if got := compare(Value{Numeric: tt.v}, entry); got != tt.want {
+			t.Errorf("compare(%#x) with %q = %v, want %v", tt.v, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestCompare_Float(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		v, test float64
+		rel     byte
+		want    bool
+	}{
+		{1.5, 1.5, '=', true},
+		{1.5, 2, '=', false},
+		{1.5, 2, '!', true},
+		{1.5, 1.5, '!', false},
+		{1.5, 1, '>', true},
+		{1.5, 2, '>', false},
+		{1.5, 2, '<', true},
+		{1.5, 1, '<', false},
+		{nan, nan, '=', false},
+		{nan, 0, '!', true},
+		{nan, 0, '>', false},
+		{nan, 0, '<', false},
+		{1, 1, '&', false},
+	}
+	for _, tt := range tests {
+		entry := &MagicEntry{Type: TypeLEDouble, Relation: tt.rel, Value: Value{Float: tt.test}}
+		if got := compare(Value{Float: tt.v}, entry); got != tt.want {
+			t.Errorf("compare(%g %c %g) = %v, want %v", tt.v, tt.rel, tt.test, got, tt.want)
+		}
+	}
+}
+
 func TestExtractValue_OutOfBounds(t *testing.T) {
 	buf := []byte{0x00, 0x01}
 	entry := &MagicEntry{Type: TypeBELong, Offset: 0}
@@ -151,3 +251,114 @@ func TestCompare_BitsClear(t *testing.T) {
 		t.Error("0xFF ^ 0x80: bit 0x80 is set, should not match")
 	}
 }
+
+func TestExtractSearch_Chunked(t *testing.T) {
+	// The pattern straddles a chunk boundary and lies past several chunks.
+	buf := make([]byte, 3*searchChunk+100)
+	at := 2*searchChunk - 2
+	copy(buf[at:], "NEEDLE")
+	entry := &MagicEntry{Type: TypeSearch, Value: Value{Str: []byte("NEEDLE"), IsString: true}}
+	val, err := extractSearch(buf, 0, entry, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := uint64(at + len("NEEDLE")); val.Numeric != want {
+		t.Errorf("end = %d, want %d", val.Numeric, want)
+	}
+
+	// StrRange bounds the start position exactly across chunks.
+	entry.StrRange = uint32(at - 1)
+	if _, err := extractSearch(buf, 0, entry, nil); err == nil {
+		t.Error("match starting past StrRange should fail")
+	}
+	entry.StrRange = uint32(at)
+	if _, err := extractSearch(buf, 0, entry, nil); err != nil {
+		t.Errorf("match starting at StrRange should succeed: %v", err)
+	}
+}
+
+func TestExtractSearch_Canceled(t *testing.T) {
+	buf := make([]byte, 4*searchChunk)
+	entry := &MagicEntry{Type: TypeSearch, Value: Value{Str: []byte("absent"), IsString: true}}
+	calls := 0
+	canceled := func() bool {
+		calls++
+		return calls > 1
+	}
+	if _, err := extractSearch(buf, 0, entry, canceled); err != errCanceled {
+		t.Errorf("err = %v, want errCanceled", err)
+	}
+	if calls != 2 {
+		t.Errorf("canceled called %d times, want 2", calls)
+	}
+}
+
+func TestBytesIndexCI(t *testing.T) {
+	tests := []struct {
+		data, pattern string
+		want          int
+	}{
+		{"Hello World", "world", 6},
+		{"Hello World", "WORLD", 6},
+		{"hello", "", 0},
+		{"abc", "abcd", -1},
+		{"xx<!DOCTYPE html>", "<!doctype", 2},
+		{"1234-1234-5678", "-5678", 9},
+		{"\xc4\xb0 istanbul", "\xc4\xb0 ISTANBUL", 0},
+		{"K", "k", -1}, // no Unicode folding
+		{"aaaab", "AAB", 2},
+	}
+	for _, tt := range tests {
+		if got := bytesIndexCI([]byte(tt.data), []byte(tt.pattern)); got != tt.want {
+			t.Errorf("bytesIndexCI(%q, %q) = %d, want %d", tt.data, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestParseOctal(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  uint64
+		wantN int
+	}{
+		{"0000644\x00", 0644, 7},
+		{"   755 \x00", 0755, 6},
+		{"00000002322\x00", 1234, 11},
+		{"17", 017, 2},
+		{"1778", 0177, 3},
+		{"1777777777777777777777", math.MaxUint64, 22},
+		{"2000000000000000000000", 0, 0},
+		{"   ", 0, 0},
+		{"\x00123", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		got, n := parseOctal([]byte(tt.in))
+		if got != tt.want || n != tt.wantN {
+			t.Errorf("parseOctal(%q) = %d, %d, want %d, %d", tt.in, got, n, tt.want, tt.wantN)
+		}
+	}
+}
+
+func TestExtractValue_ID3(t *testing.T) {
+	buf := []byte{0x00, 0x00, 0x02, 0x2c, 0x7f, 0x7f, 0x7f, 0x7f}
+	tests := []struct {
+		typ    FileType
+		offset int
+		want   uint64
+	}{
+		{TypeBEID3, 0, 300},
+		{TypeLEID3, 0, 0x2c<<21 | 0x02<<14},
+		{TypeBEID3, 4, 1<<28 - 1},
+		{TypeLEID3, 2, 0x7f<<21 | 0x7f<<14 | 0x2c<<7 | 0x02},
+	}
+	for _, tt := range tests {
+		val, err := extractValue(buf, tt.offset, &MagicEntry{Type: tt.typ})
+		if err != nil || val.Numeric != tt.want {
+			t.Errorf("extractValue(type %d, offset %d) = %d, %v, want %d", tt.typ, tt.offset, val.Numeric, err, tt.want)
+		}
+	}
+	if _, err := extractValue(buf, 6, &MagicEntry{Type: TypeBEID3}); err != errShortBuffer {
+		t.Errorf("extractValue past the end: error = %v, want errShortBuffer", err)
+	}
+}
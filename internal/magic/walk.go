@@ -0,0 +1,245 @@
+package magic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WalkOptions controls recursive identification.
+type WalkOptions struct {
+	// FollowSymlinks identifies the targets of symbolic links, and descends
+	// into linked directories, instead of reporting the links themselves.
+	FollowSymlinks bool
+	// SkipHidden skips files and directories whose name starts with ".".
+	SkipHidden bool
+	// Include, if non-empty, limits the reported entries to those matching
+	// at least one pattern. Directories are still descended into.
+	Include []string
+	// Exclude skips entries matching any pattern; excluded directories are
+	// not descended into.
+	Exclude []string
+	// MaxDepth limits how deep below the root the walk descends; the root
+	// is at depth 0 and its entries at depth 1. Zero means unlimited.
+	MaxDepth int
+	// MaxSize skips regular files larger than MaxSize bytes. Zero means unlimited.
+	MaxSize int64
+}
+
+// matchAny reports whether rel, a slash-separated path relative to the
+// walk root, or its base name matches one of patterns. Patterns use
+// path.Match syntax; those containing "/" are matched against rel, others
+// against the base name.
+func matchAny(patterns []string, rel, name string) bool {
+	for _, p := range patterns {
+		target := name
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkResult is the outcome of identifying one entry of a walk.
+type WalkResult struct {
+	Path   string
+	Result Result
+	Err    error // error opening, reading or listing the entry
+}
+
+// WalkFunc is called for each entry of a walk. Returning fs.SkipAll stops
+// the walk without error, fs.SkipDir skips the remaining entries of the
+// directory being listed, and any other non-nil error stops the walk and
+// is returned by Walk.
+type WalkFunc func(WalkResult) error
+
+// Walk identifies root and, if it is a directory, everything below it, in
+// lexical order. Reported paths start with root, like filepath.WalkDir.
+func (fi *FileIdentifier) Walk(ctx context.Context, root string, opts WalkOptions, fn WalkFunc) error {
+	stat := os.Lstat
+	if opts.FollowSymlinks {
+		stat = os.Stat
+	}
+	info, err := stat(root)
+	if err != nil {
+		return err
+	}
+	dir, start := root, "."
+	if !info.IsDir() {
+		dir, start = filepath.Dir(root), filepath.Base(root)
+	}
+	// The root is not statted again through os.DirFS, which may lack
+	// Lstat and so follow a symlinked root.
+	return fi.walk(ctx, os.DirFS(dir), start, info, opts, fn, func(name string) string {
+		if name == start {
+			return root
+		}
+		return filepath.Join(dir, filepath.FromSlash(name))
+	})
+}
+
+// WalkFS is like Walk for the tree rooted at root in fsys, which may be an
+// embed.FS, a *zip.Reader or any other fs.FS. Reported paths are fsys
+// names, as with fs.WalkDir.
+func (fi *FileIdentifier) WalkFS(ctx context.Context, fsys fs.FS, root string, opts WalkOptions, fn WalkFunc) error {
+	return fi.walk(ctx, fsys, root, nil, opts, fn, func(name string) string { return name })
+}
+
+// walker holds the state of one walk over an fs.FS.
+type walker struct {
+	fi      *FileIdentifier
+	ctx     context.Context
+	fsys    fs.FS
+	start   string // fsys name of the walk root
+	opts    WalkOptions
+	fn      WalkFunc
+	display func(name string) string // maps fsys names to reported paths
+	parents []fs.FileInfo            // directories being walked, for symlink cycles
+}
+
+// walk walks the tree rooted at start in fsys. info describes start; if it
+// is nil, start is statted in fsys.
+func (fi *FileIdentifier) walk(ctx context.Context, fsys fs.FS, start string, info fs.FileInfo, opts WalkOptions, fn WalkFunc, display func(string) string) error {
+	w := &walker{fi: fi, ctx: ctx, fsys: fsys, start: start, opts: opts, fn: fn, display: display}
+	if info == nil {
+		var err error
+		if info, err = w.stat(start, nil); err != nil {
+			return err
+		}
+	}
+	err := w.visit(start, info, 0)
+	if errors.Is(err, fs.SkipAll) || errors.Is(err, fs.SkipDir) {
+		return nil
+	}
+	return err
+}
+
+// stat returns the FileInfo to identify name by: the entry itself, or its
+// target when following symlinks. A broken link is reported as a link.
+func (w *walker) stat(name string, d fs.DirEntry) (fs.FileInfo, error) {
+	if d == nil {
+		if w.opts.FollowSymlinks {
+			return fs.Stat(w.fsys, name)
+		}
+		if lfs, ok := w.fsys.(interface {
+			Lstat(string) (fs.FileInfo, error)
+		}); ok {
+			return lfs.Lstat(name)
+		}
+		return fs.Stat(w.fsys, name)
+	}
+	if w.opts.FollowSymlinks && d.Type()&fs.ModeSymlink != 0 {
+		if info, err := fs.Stat(w.fsys, name); err == nil {
+			return info, nil
+		}
+	}
+	return d.Info()
+}
+
+// rel returns name relative to the walk root.
+func (w *walker) rel(name string) string {
+	if w.start == "." {
+		return name
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, w.start), "/")
+}
+
+// visit reports name and, for directories, walks its entries.
+func (w *walker) visit(name string, info fs.FileInfo, depth int) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	isDir := info.IsDir()
+	report := len(w.opts.Include) == 0 || matchAny(w.opts.Include, w.rel(name), path.Base(name))
+	if !isDir {
+		if !report {
+			return nil
+		}
+		if w.opts.MaxSize > 0 && info.Mode().IsRegular() && info.Size() > w.opts.MaxSize {
+			return nil
+		}
+		result, err := w.fi.identifyFSFile(w.ctx, w.fsys, name, info)
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		return w.fn(WalkResult{Path: w.display(name), Result: result, Err: err})
+	}
+
+	descend := w.opts.MaxDepth == 0 || depth < w.opts.MaxDepth
+	for _, p := range w.parents {
+		if os.SameFile(p, info) {
+			descend = false // symlink cycle
+		}
+	}
+	var entries []fs.DirEntry
+	var readErr error
+	if descend {
+		entries, readErr = fs.ReadDir(w.fsys, name)
+	}
+	if report {
+		err := w.fn(WalkResult{Path: w.display(name), Result: identifyFS(info), Err: readErr})
+		if errors.Is(err, fs.SkipDir) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	w.parents = append(w.parents, info)
+	defer func() { w.parents = w.parents[:len(w.parents)-1] }()
+	for _, d := range entries {
+		if w.opts.SkipHidden && strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		child := path.Join(name, d.Name())
+		if matchAny(w.opts.Exclude, w.rel(child), d.Name()) {
+			continue
+		}
+		childInfo, err := w.stat(child, d)
+		if err != nil {
+			err = w.fn(WalkResult{Path: w.display(child), Err: err})
+		} else {
+			err = w.visit(child, childInfo, depth+1)
+		}
+		if errors.Is(err, fs.SkipDir) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// identifyFSFile identifies the file name in fsys described by info. Files
+// that implement io.ReaderAt get random access, like files on disk; others
+// are read as a stream.
+func (fi *FileIdentifier) identifyFSFile(ctx context.Context, fsys fs.FS, name string, info fs.FileInfo) (Result, error) {
+	if !info.Mode().IsRegular() {
+		return identifyFS(info), nil
+	}
+	if info.Size() == 0 {
+		return emptyFileResult(), nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return Result{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	if ra, ok := f.(io.ReaderAt); ok {
+		return fi.identifyReaderAt(ctx, ra, info.Size(), info.Mode())
+	}
+	return fi.identifyStream(ctx, f, info.Mode())
+}
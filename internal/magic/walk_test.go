@@ -0,0 +1,227 @@
+package magic
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func walkFSDescs(t *testing.T, fi *FileIdentifier, fsys fs.FS, root string, opts WalkOptions) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	err := fi.WalkFS(context.Background(), fsys, root, opts, func(wr WalkResult) error {
+		if wr.Err != nil {
+			t.Errorf("%s: %v", wr.Path, wr.Err)
+		}
+		got[wr.Path] = wr.Result.Desc
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkFS: %v", err)
+	}
+	return got
+}
+
+func TestWalkFS(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	fsys := fstest.MapFS{
+		"docs/a.pdf":         {Data: []byte("%PDF-1.4\n")},
+		"docs/big.pdf":       {Data: append([]byte("%PDF-1.4\n"), make([]byte, 100)...)},
+		"docs/sub/b.gif":     {Data: []byte("GIF89a")},
+		"docs/.hidden/c.gif": {Data: []byte("GIF89a")},
+		"docs/notes.txt":     {Data: []byte("hello\n")},
+		"docs/empty":         {Data: []byte{}},
+	}
+
+	tests := []struct {
+		name string
+		opts WalkOptions
+		want map[string]string
+	}{
+		{"all", WalkOptions{}, map[string]string{
+			"docs":               "directory",
+			"docs/.hidden":       "directory",
+			"docs/.hidden/c.gif": "GIF image data",
+			"docs/a.pdf":         "PDF document",
+			"docs/big.pdf":       "PDF document",
+			"docs/empty":         "empty",
+			"docs/notes.txt":     "ASCII text",
+			"docs/sub":           "directory",
+			"docs/sub/b.gif":     "GIF image data",
+		}},
+		{"skip hidden, max size", WalkOptions{SkipHidden: true, MaxSize: 50}, map[string]string{
+			"docs":           "directory",
+			"docs/a.pdf":     "PDF document",
+			"docs/empty":     "empty",
+			"docs/notes.txt": "ASCII text",
+			"docs/sub":       "directory",
+			"docs/sub/b.gif": "GIF image data",
+		}},
+		{"include", WalkOptions{Include: []string{"*.gif", "a.*"}}, map[string]string{
+			"docs/.hidden/c.gif": "GIF image data",
+			"docs/a.pdf":         "PDF document",
+			"docs/sub/b.gif":     "GIF image data",
+		}},
+		{"exclude", WalkOptions{Exclude: []string{".*", "sub/*", "*.pdf"}}, map[string]string{
+			"docs":           "directory",
+			"docs/empty":     "empty",
+			"docs/notes.txt": "ASCII text",
+			"docs/sub":       "directory",
+		}},
+		{"max depth", WalkOptions{MaxDepth: 1, SkipHidden: true, Include: []string{"*"}}, map[string]string{
+			"docs":           "directory",
+			"docs/a.pdf":     "PDF document",
+			"docs/big.pdf":   "PDF document",
+			"docs/empty":     "empty",
+			"docs/notes.txt": "ASCII text",
+			"docs/sub":       "directory",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walkFSDescs(t, fi, fsys, "docs", tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkFS_Zip(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string]string{"x/a.pdf": "%PDF-1.7\n", "x/b.gif": "GIF87a"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := walkFSDescs(t, fi, zr, ".", WalkOptions{})
+	want := map[string]string{".": "directory", "x": "directory", "x/a.pdf": "PDF document", "x/b.gif": "GIF image data"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestWalk_Symlinks(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "d", "a.pdf"), []byte("%PDF-1.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.pdf", filepath.Join(root, "d", "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink("..", filepath.Join(root, "d", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(opts WalkOptions) map[string]string {
+		got := make(map[string]string)
+		err := fi.Walk(context.Background(), root, opts, func(wr WalkResult) error {
+			rel, _ := filepath.Rel(root, wr.Path)
+			got[filepath.ToSlash(rel)] = wr.Result.Desc
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		return got
+	}
+
+	want := map[string]string{".": "directory", "d": "directory", "d/a.pdf": "PDF document", "d/link": "symbolic link", "d/loop": "symbolic link"}
+	if got := walk(WalkOptions{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("no follow: got %v\nwant %v", got, want)
+	}
+	// Following links identifies targets; the loop back to root is reported but not descended.
+	want = map[string]string{".": "directory", "d": "directory", "d/a.pdf": "PDF document", "d/link": "PDF document", "d/loop": "directory"}
+	if got := walk(WalkOptions{FollowSymlinks: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("follow: got %v\nwant %v", got, want)
+	}
+
+	// A file root is identified on its own and reported with the given path.
+	var paths []string
+	err := fi.Walk(context.Background(), filepath.Join(root, "d", "a.pdf"), WalkOptions{}, func(wr WalkResult) error {
+		paths = append(paths, wr.Path)
+		return nil
+	})
+	if err != nil || len(paths) != 1 || paths[0] != filepath.Join(root, "d", "a.pdf") {
+		t.Errorf("file root: got %v, %v", paths, err)
+	}
+
+	// A symlinked root is reported as a link unless links are followed.
+	linkRoot := filepath.Join(t.TempDir(), "root")
+	if err := os.Symlink(root, linkRoot); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		opts WalkOptions
+		want string
+		n    int
+	}{
+		{WalkOptions{}, "symbolic link", 1},
+		{WalkOptions{FollowSymlinks: true}, "directory", 5},
+	} {
+		got := make(map[string]string)
+		err := fi.Walk(context.Background(), linkRoot, tt.opts, func(wr WalkResult) error {
+			got[wr.Path] = wr.Result.Desc
+			return nil
+		})
+		if err != nil || got[linkRoot] != tt.want || len(got) != tt.n {
+			t.Errorf("symlinked root, %+v: got %v, %v; want %s root and %d entries", tt.opts, got, err, tt.want, tt.n)
+		}
+	}
+}
+
+func TestWalk_Stop(t *testing.T) {
+	fi := newBatchTestIdentifier(t)
+	fsys := fstest.MapFS{
+		"a/1": {Data: []byte("x\n")},
+		"a/2": {Data: []byte("x\n")},
+		"b/1": {Data: []byte("x\n")},
+	}
+
+	var seen []string
+	err := fi.WalkFS(context.Background(), fsys, ".", WalkOptions{}, func(wr WalkResult) error {
+		seen = append(seen, wr.Path)
+		switch wr.Path {
+		case "a/1":
+			return fs.SkipDir
+		case "b":
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkFS: %v", err)
+	}
+	if want := []string{".", "a", "a/1", "b"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("visited %v, want %v", seen, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fi.WalkFS(ctx, fsys, ".", WalkOptions{}, func(WalkResult) error { return nil }); err != context.Canceled {
+		t.Errorf("canceled walk: err = %v, want %v", err, context.Canceled)
+	}
+}